@@ -6,7 +6,14 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
 
 	"github.com/mholt/acmez"
 	"github.com/mholt/acmez/acme"
@@ -14,25 +21,54 @@ import (
 )
 
 // const DefaultAcmeDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory" // Staging endpoint
-const DefaultAcmeDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+const DefaultAcmeDirectory = LetsEncryptDirectory
+
+const (
+	KeyTypeECDSA = "ecdsa" // P-256, the default
+	KeyTypeRSA   = "rsa"   // 2048 bits, for integrations without ECDSA support
+)
+
+// Preflighter is implemented by solvers that can check their setup for the domains before an order is placed
+type Preflighter interface {
+	Preflight(ctx context.Context, domains []string) error
+}
 
 type Acme struct {
-	Directory  string
-	AccountKey crypto.Signer
-	Logger     *zap.Logger
-	AlbArn     string
-	HttpSolver acmez.Solver
+	Directory     string
+	AccountKey    crypto.Signer
+	Logger        *zap.Logger
+	AlbArn        string
+	HttpSolver    acmez.Solver
+	DnsSolver     acmez.Solver
+	TlsAlpnSolver acmez.Solver
+	KeyType       string
+	Resolvers     []string // resolvers to look up CAA records with, the system resolvers when empty
+	SkipCAACheck  bool
 }
 
 func (a Acme) GetCertificate(ctx context.Context, domains []string) (crypto.Signer, []byte, error) {
+	// Failing before ordering avoids failed authorizations, which count against the CA rate limits
+	for _, solver := range []acmez.Solver{a.HttpSolver, a.DnsSolver, a.TlsAlpnSolver} {
+		if p, ok := solver.(Preflighter); ok {
+			if err := p.Preflight(ctx, domains); err != nil {
+				return nil, nil, fmt.Errorf("preflight check: %w", err)
+			}
+		}
+	}
+
+	orderId, err := newOrderId()
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating order id: %v", err)
+	}
+	log.Printf("Ordering certificate for %v, order id %v", domains, orderId)
+	ctx = alb.WithOrderId(ctx, orderId)
+
 	client := acmez.Client{
 		Client: &acme.Client{
 			Directory: a.Directory,
 			Logger:    a.Logger,
 		},
-		ChallengeSolvers: map[string]acmez.Solver{
-			acme.ChallengeTypeHTTP01: a.HttpSolver,
-		},
+		ChallengeSolvers: a.solvers(),
 	}
 
 	// NewAccount would load an existing account if one exists
@@ -44,7 +80,23 @@ func (a Acme) GetCertificate(ctx context.Context, domains []string) (crypto.Sign
 		return nil, nil, fmt.Errorf("new account: %v", err)
 	}
 
-	certPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// The account URL is needed for accounturi parameters, the CAA records are still checked before ordering
+	if !a.SkipCAACheck {
+		methods, err := a.checkCAA(ctx, client.Client, account.Location, domains)
+		if err != nil {
+			return nil, nil, fmt.Errorf("CAA check: %w", err)
+		}
+		// acmez picks any challenge type offered that has a solver, the CA would refuse the ones the
+		// validationmethods parameters do not allow
+		for challengeType := range client.ChallengeSolvers {
+			if !slices.Contains(methods, challengeType) {
+				log.Printf("CAA records do not allow %v challenges, not using its solver", challengeType)
+				delete(client.ChallengeSolvers, challengeType)
+			}
+		}
+	}
+
+	certPrivateKey, err := generateCertificateKey(a.KeyType)
 	if err != nil {
 		return nil, nil, fmt.Errorf("generating certificate key: %v", err)
 	}
@@ -62,3 +114,72 @@ func (a Acme) GetCertificate(ctx context.Context, domains []string) (crypto.Sign
 	return certPrivateKey, certs[0].ChainPEM, nil
 
 }
+
+// checkCAA checks the CAA records permit issuance for the domains and returns the challenge types they permit
+func (a Acme) checkCAA(ctx context.Context, client *acme.Client, accountURI string, domains []string) ([]string, error) {
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory: %w", err)
+	}
+	policy := CAAPolicy{AccountURI: accountURI, Methods: a.ChallengeTypes()}
+	if dir.Meta != nil {
+		policy.Identities = dir.Meta.CAAIdentities
+	}
+	return policy.Check(ctx, domains, a.Resolvers)
+}
+
+// ChallengeTypes returns the challenge types of the configured solvers
+func (a Acme) ChallengeTypes() []string {
+	var types []string
+	for challengeType := range a.solvers() {
+		types = append(types, challengeType)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// solvers returns the configured solvers by challenge type
+func (a Acme) solvers() map[string]acmez.Solver {
+	solvers := make(map[string]acmez.Solver)
+	for challengeType, solver := range map[string]acmez.Solver{
+		acme.ChallengeTypeHTTP01:    a.HttpSolver,
+		acme.ChallengeTypeDNS01:     a.DnsSolver,
+		acme.ChallengeTypeTLSALPN01: a.TlsAlpnSolver,
+	} {
+		if solver != nil {
+			solvers[challengeType] = solver
+		}
+	}
+	return solvers
+}
+
+// newOrderId identifies the rules created while solving the challenges of one order
+func newOrderId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func generateCertificateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// splitList returns the non-empty items of a comma separated list, without surrounding spaces
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,100 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+)
+
+const TagPlaceholder = "cloudacme:placeholder"
+
+const placeholderValidity = 90 * 24 * time.Hour
+
+// Bootstrap prepares new domains for their first ALB triggered issuance: a self signed placeholder certificate
+// for all the domains is imported into ACM and attached to the HTTPS listener, and an HTTP trigger rule for the
+// lambda is installed for each domain. The certificate is found and tagged by the first domain. Steps that are
+// already done, such as an existing certificate for the domain, are skipped.
+func Bootstrap(ctx context.Context, albArn, lambdaArn string, domains []string) error {
+	if len(domains) == 0 {
+		return errors.New("no domains to bootstrap")
+	}
+	domain := domains[0]
+
+	certArn, _, err := GetExistingCertificate(ctx, albArn, domain)
+	if errors.Is(err, ErrCertificateNotFound) {
+		key, chain, err := CreatePlaceholderCertificate(domains...)
+		if err != nil {
+			return fmt.Errorf("failed to create placeholder certificate: %w", err)
+		}
+
+		tags := ManagedCertificateTags(domain, TargetAlb)
+		tags[TagPlaceholder] = "true"
+		certArn, err = ImportCertificate(ctx, nil, "", key, chain, "", tags)
+		if err != nil {
+			return fmt.Errorf("failed to import placeholder certificate: %w", err)
+		}
+		log.Printf("Imported placeholder certificate %v for %v", certArn, domain)
+
+		if err := AttachCertificate(ctx, albArn, certArn); err != nil {
+			return fmt.Errorf("failed to attach placeholder certificate %v: %w", certArn, err)
+		}
+		log.Printf("Attached placeholder certificate %v to ALB %v", certArn, albArn)
+	} else if err != nil {
+		return fmt.Errorf("failed to get existing certificate: %w", err)
+	} else {
+		log.Printf("Certificate %v for %v is already attached to ALB %v", certArn, domain, albArn)
+	}
+
+	// One rule per domain, the first request to any of them issues the certificate for all
+	for _, d := range domains {
+		if err := SetupHttpRule(ctx, albArn, lambdaArn, alb.RuleCondition{
+			HostHeader:  []string{d},
+			PathPattern: []string{"/"},
+		}); err != nil {
+			return fmt.Errorf("failed to setup http rule for %v: %w", d, err)
+		}
+	}
+	return nil
+}
+
+// CreatePlaceholderCertificate generates a self signed certificate for the domains, returned as its key and PEM chain.
+func CreatePlaceholderCertificate(domains ...string) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating certificate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domains[0]},
+		DNSNames:              domains,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(placeholderValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,259 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DefangLabs/cloudacme/solver"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+// caaTags are the CAA property tags understood, a critical record with any other tag forbids issuance
+var caaTags = []string{"issue", "issuewild", "iodef", "contactemail", "contactphone"}
+
+// CAARecord is a record of the relevant CAA record set of a domain
+type CAARecord struct {
+	Flag  uint8
+	Tag   string
+	Value string
+}
+
+func (r CAARecord) String() string {
+	return fmt.Sprintf("%d %v %q", r.Flag, r.Tag, r.Value)
+}
+
+// CAASet is the relevant CAA record set of a domain, found at Name, the domain itself or its closest
+// ancestor with CAA records. Name is empty when no CAA records were found, which permits any CA.
+type CAASet struct {
+	Name    string
+	Records []CAARecord
+}
+
+// CAAPolicy is what the CA checks the CAA records against, RFC 8659 with the parameters of RFC 8657
+type CAAPolicy struct {
+	Identities []string // issuer domain names of the CA, from the caaIdentities of the directory
+	AccountURI string   // the account URL, accounturi parameters are not checked when empty
+	Methods    []string // the challenge types of the configured solvers
+}
+
+// CAAResult is the evaluation of the CAA records of a domain
+type CAAResult struct {
+	Domain    string
+	Set       CAASet
+	Permitted bool
+	Methods   []string // the challenge types of the policy the records permit
+	Reason    string
+}
+
+// CAAIdentities returns the issuer domain names the CA of the directory recognizes in CAA records
+func CAAIdentities(ctx context.Context, directory string) ([]string, error) {
+	client := &acme.Client{Directory: directory}
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory %v: %w", directory, err)
+	}
+	if dir.Meta == nil {
+		return nil, nil
+	}
+	return dir.Meta.CAAIdentities, nil
+}
+
+// Check evaluates the CAA records of every domain and returns an error listing the domains the CA may not
+// issue for, so that the order does not fail late on a CAA record. Otherwise it returns the challenge types
+// of the policy the records of every domain permit, as the solvers of the other types must not be used.
+func (p CAAPolicy) Check(ctx context.Context, domains []string, resolvers []string) ([]string, error) {
+	results, err := p.Evaluate(ctx, domains, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	methods := p.Methods
+	var problems []string
+	for _, r := range results {
+		if r.Permitted {
+			log.Printf("CAA records permit issuance for %v: %v", r.Domain, r.Reason)
+			methods = slices.DeleteFunc(slices.Clone(methods), func(m string) bool { return !slices.Contains(r.Methods, m) })
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("  %v: %v", r.Domain, r.Reason))
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("CAA records forbid issuance by " + strings.Join(p.Identities, ", ") + ":\n" + strings.Join(problems, "\n"))
+	}
+	if len(methods) == 0 && len(p.Methods) > 0 {
+		return nil, fmt.Errorf("CAA records of the domains permit no common challenge type among %v", strings.Join(p.Methods, ", "))
+	}
+	return methods, nil
+}
+
+// Evaluate looks up the relevant CAA record set of every domain and evaluates it against the policy
+func (p CAAPolicy) Evaluate(ctx context.Context, domains []string, resolvers []string) ([]CAAResult, error) {
+	results := make([]CAAResult, 0, len(domains))
+	for _, domain := range domains {
+		set, err := LookupCAA(ctx, domain, resolvers)
+		if err != nil {
+			return nil, err
+		}
+		permitted, methods, reason := p.Permits(domain, set)
+		results = append(results, CAAResult{Domain: domain, Set: set, Permitted: permitted, Methods: methods, Reason: reason})
+	}
+	return results, nil
+}
+
+// LookupCAA returns the relevant CAA record set of domain: the CAA records of the domain, or of its closest
+// ancestor with CAA records, following CNAME records. A lookup failure is an error, as the CA does not issue
+// when it cannot look up the CAA records either.
+func LookupCAA(ctx context.Context, domain string, resolvers []string) (CAASet, error) {
+	servers, err := solver.ResolverAddrs(resolvers)
+	if err != nil {
+		return CAASet{}, err
+	}
+
+	name := dns.Fqdn(strings.TrimPrefix(strings.ToLower(domain), "*."))
+	for name != "." {
+		records, err := queryCAA(ctx, name, servers)
+		if err != nil {
+			return CAASet{}, err
+		}
+		if len(records) > 0 {
+			return CAASet{Name: strings.TrimSuffix(name, "."), Records: records}, nil
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		if parent == "" {
+			parent = "."
+		}
+		name = parent
+	}
+	return CAASet{}, nil
+}
+
+func queryCAA(ctx context.Context, name string, servers []string) ([]CAARecord, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeCAA)
+
+	var lastErr error
+	for _, server := range servers {
+		client := new(dns.Client)
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%v answered %v", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		var records []CAARecord
+		for _, rr := range resp.Answer {
+			// the resolver follows CNAME records, the CAA records of the target apply
+			if caa, ok := rr.(*dns.CAA); ok {
+				records = append(records, CAARecord{Flag: caa.Flag, Tag: strings.ToLower(caa.Tag), Value: caa.Value})
+			}
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("failed to look up CAA records of %v: %w", name, lastErr)
+}
+
+// Permits reports whether the relevant CAA record set of domain permits issuance under the policy, the
+// challenge types of the policy the records permit, and why
+func (p CAAPolicy) Permits(domain string, set CAASet) (bool, []string, string) {
+	if len(set.Records) == 0 {
+		return true, p.Methods, "no CAA records"
+	}
+	for _, r := range set.Records {
+		if r.Flag&128 != 0 && !slices.Contains(caaTags, r.Tag) {
+			return false, nil, fmt.Sprintf("critical CAA record %v at %v is not understood", r, set.Name)
+		}
+	}
+
+	tag := "issue"
+	if strings.HasPrefix(domain, "*.") && slices.ContainsFunc(set.Records, func(r CAARecord) bool { return r.Tag == "issuewild" }) {
+		tag = "issuewild"
+	}
+	var relevant []CAARecord
+	for _, r := range set.Records {
+		if r.Tag == tag {
+			relevant = append(relevant, r)
+		}
+	}
+	if len(relevant) == 0 {
+		return true, p.Methods, fmt.Sprintf("no %v records at %v", tag, set.Name)
+	}
+	if len(p.Identities) == 0 {
+		return true, p.Methods, "the directory lists no CAA identities, the records at " + set.Name + " are not checked"
+	}
+
+	// issuance is permitted by any record, with the challenge types of all the records that permit it
+	var permitting, refused []string
+	var methods []string
+	for _, r := range relevant {
+		issuer, params := parseCAAValue(r.Value)
+		if issuer == "" {
+			refused = append(refused, fmt.Sprintf("%v forbids any CA", r))
+			continue
+		}
+		if !slices.ContainsFunc(p.Identities, func(id string) bool { return strings.EqualFold(id, issuer) }) {
+			refused = append(refused, fmt.Sprintf("%v names another CA", r))
+			continue
+		}
+		unchecked := ""
+		if uri, ok := params["accounturi"]; ok {
+			if p.AccountURI == "" {
+				unchecked = ", account " + uri + " not checked"
+			} else if uri != p.AccountURI {
+				refused = append(refused, fmt.Sprintf("%v is for another account than %v", r, p.AccountURI))
+				continue
+			}
+		}
+		allowed := p.Methods
+		if list, ok := params["validationmethods"]; ok {
+			var listed []string
+			for _, m := range strings.Split(list, ",") {
+				listed = append(listed, strings.ToLower(strings.TrimSpace(m)))
+			}
+			allowed = slices.DeleteFunc(slices.Clone(p.Methods), func(m string) bool { return !slices.Contains(listed, m) })
+			if len(allowed) == 0 {
+				refused = append(refused, fmt.Sprintf("%v does not allow the challenge types %v", r, strings.Join(p.Methods, ", ")))
+				continue
+			}
+			unchecked += ", only " + strings.Join(allowed, ", ")
+		}
+		for _, m := range allowed {
+			if !slices.Contains(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+		permitting = append(permitting, fmt.Sprintf("%v%v", r, unchecked))
+	}
+	if len(permitting) > 0 {
+		slices.Sort(methods)
+		return true, methods, fmt.Sprintf("records at %v: %v", set.Name, strings.Join(permitting, "; "))
+	}
+	return false, nil, fmt.Sprintf("records at %v: %v", set.Name, strings.Join(refused, "; "))
+}
+
+// parseCAAValue splits the value of an issue or issuewild record into its issuer domain name and parameters
+func parseCAAValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	issuer := strings.TrimSpace(parts[0])
+	params := make(map[string]string)
+	for _, part := range parts[1:] {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(val)
+		}
+	}
+	return issuer, params
+}
+
+// DnsResolversFromEnv returns the comma separated resolvers in ACME_DNS_RESOLVERS, the system resolvers are
+// used when empty
+func DnsResolversFromEnv() []string {
+	return splitList(os.Getenv("ACME_DNS_RESOLVERS"))
+}
@@ -0,0 +1,213 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseCAAValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		issuer string
+		params map[string]string
+	}{
+		{"letsencrypt.org", "letsencrypt.org", map[string]string{}},
+		{";", "", map[string]string{}},
+		{"", "", map[string]string{}},
+		{" letsencrypt.org ; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/1", "letsencrypt.org", map[string]string{
+			"accounturi": "https://acme-v02.api.letsencrypt.org/acme/acct/1",
+		}},
+		{"letsencrypt.org; validationmethods=dns-01,http-01; AccountURI = x", "letsencrypt.org", map[string]string{
+			"validationmethods": "dns-01,http-01",
+			"accounturi":        "x",
+		}},
+		{"letsencrypt.org; novalue", "letsencrypt.org", map[string]string{}},
+	}
+	for _, tt := range tests {
+		issuer, params := parseCAAValue(tt.value)
+		if issuer != tt.issuer {
+			t.Errorf("parseCAAValue(%q) issuer = %q, want %q", tt.value, issuer, tt.issuer)
+		}
+		if len(params) != len(tt.params) {
+			t.Errorf("parseCAAValue(%q) params = %v, want %v", tt.value, params, tt.params)
+			continue
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("parseCAAValue(%q) params = %v, want %v", tt.value, params, tt.params)
+			}
+		}
+	}
+}
+
+func TestPermits(t *testing.T) {
+	const account = "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+	policy := CAAPolicy{
+		Identities: []string{"letsencrypt.org"},
+		AccountURI: account,
+		Methods:    []string{"dns-01", "http-01"},
+	}
+	set := func(records ...CAARecord) CAASet {
+		return CAASet{Name: "example.com", Records: records}
+	}
+	issue := func(value string) CAARecord { return CAARecord{Tag: "issue", Value: value} }
+	issuewild := func(value string) CAARecord { return CAARecord{Tag: "issuewild", Value: value} }
+
+	tests := []struct {
+		name    string
+		policy  CAAPolicy
+		domain  string
+		set     CAASet
+		want    bool
+		methods []string
+	}{
+		{"no records", policy, "www.example.com", CAASet{}, true, []string{"dns-01", "http-01"}},
+		{"issue for the CA", policy, "www.example.com", set(issue("letsencrypt.org")), true, []string{"dns-01", "http-01"}},
+		{"issuer case insensitive", policy, "www.example.com", set(issue("LetsEncrypt.org")), true, []string{"dns-01", "http-01"}},
+		{"issue for another CA", policy, "www.example.com", set(issue("pki.goog")), false, nil},
+		{"any of the issue records", policy, "www.example.com", set(issue("pki.goog"), issue("letsencrypt.org")), true, []string{"dns-01", "http-01"}},
+		{"deny all", policy, "www.example.com", set(issue(";")), false, nil},
+		{"only iodef", policy, "www.example.com", set(CAARecord{Tag: "iodef", Value: "mailto:security@example.com"}), true, []string{"dns-01", "http-01"}},
+		{"issuewild ignored for a name", policy, "www.example.com", set(issue("letsencrypt.org"), issuewild(";")), true, []string{"dns-01", "http-01"}},
+		{"issuewild for a wildcard", policy, "*.example.com", set(issue(";"), issuewild("letsencrypt.org")), true, []string{"dns-01", "http-01"}},
+		{"issuewild denies a wildcard", policy, "*.example.com", set(issue("letsencrypt.org"), issuewild(";")), false, nil},
+		{"issue for a wildcard without issuewild", policy, "*.example.com", set(issue("pki.goog")), false, nil},
+		{"critical unknown tag", policy, "www.example.com", set(issue("letsencrypt.org"), CAARecord{Flag: 128, Tag: "tbs", Value: "x"}), false, nil},
+		{"non critical unknown tag", policy, "www.example.com", set(issue("letsencrypt.org"), CAARecord{Tag: "tbs", Value: "x"}), true, []string{"dns-01", "http-01"}},
+		{"critical known tag", policy, "www.example.com", set(CAARecord{Flag: 128, Tag: "issue", Value: "letsencrypt.org"}), true, []string{"dns-01", "http-01"}},
+		{"same account", policy, "www.example.com", set(issue("letsencrypt.org; accounturi=" + account)), true, []string{"dns-01", "http-01"}},
+		{"other account", policy, "www.example.com", set(issue("letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/2")), false, nil},
+		{"account not known", CAAPolicy{Identities: policy.Identities, Methods: policy.Methods}, "www.example.com", set(issue("letsencrypt.org; accounturi=" + account)), true, []string{"dns-01", "http-01"}},
+		{"validation method allowed", policy, "www.example.com", set(issue("letsencrypt.org; validationmethods=dns-01")), true, []string{"dns-01"}},
+		{"validation methods case and spaces", policy, "www.example.com", set(issue("letsencrypt.org; validationmethods=HTTP-01 , tls-alpn-01")), true, []string{"http-01"}},
+		{"validation method not configured", policy, "www.example.com", set(issue("letsencrypt.org; validationmethods=tls-alpn-01")), false, nil},
+		{"methods of all permitting records", policy, "www.example.com", set(issue("letsencrypt.org; validationmethods=dns-01"), issue("letsencrypt.org; validationmethods=http-01")), true, []string{"dns-01", "http-01"}},
+		{"no identities in directory", CAAPolicy{Methods: policy.Methods}, "www.example.com", set(issue("pki.goog")), true, []string{"dns-01", "http-01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, methods, reason := tt.policy.Permits(tt.domain, tt.set)
+			if got != tt.want {
+				t.Errorf("Permits() = %v (%v), want %v", got, reason, tt.want)
+			}
+			if !slices.Equal(methods, tt.methods) {
+				t.Errorf("Permits() methods = %v, want %v", methods, tt.methods)
+			}
+		})
+	}
+}
+
+// caaServer answers CAA queries from records by name, and with SERVFAIL for the names in fail
+func caaServer(t *testing.T, records map[string][]dns.RR, fail ...string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		if slices.Contains(fail, name) {
+			m.Rcode = dns.RcodeServerFailure
+		} else if r.Question[0].Qtype == dns.TypeCAA {
+			m.Answer = records[name]
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func caaRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestLookupCAA(t *testing.T) {
+	records := map[string][]dns.RR{
+		"example.com.": {
+			caaRR(t, `example.com. 300 IN CAA 0 issue "letsencrypt.org"`),
+			caaRR(t, `example.com. 300 IN CAA 0 iodef "mailto:security@example.com"`),
+		},
+		"shop.example.com.": {
+			caaRR(t, `shop.example.com. 300 IN CAA 128 issue "pki.goog"`),
+		},
+		// a resolver following a CNAME answers with the records of the target
+		"alias.example.org.": {
+			caaRR(t, `alias.example.org. 300 IN CNAME shop.example.com.`),
+			caaRR(t, `shop.example.com. 300 IN CAA 128 issue "pki.goog"`),
+		},
+	}
+	server := caaServer(t, records, "broken.example.net.")
+	ctx := context.Background()
+
+	tests := []struct {
+		domain  string
+		name    string
+		records []CAARecord
+		wantErr bool
+	}{
+		{domain: "example.com", name: "example.com", records: []CAARecord{{0, "issue", "letsencrypt.org"}, {0, "iodef", "mailto:security@example.com"}}},
+		{domain: "www.example.com", name: "example.com", records: []CAARecord{{0, "issue", "letsencrypt.org"}, {0, "iodef", "mailto:security@example.com"}}},
+		{domain: "a.b.example.com", name: "example.com", records: []CAARecord{{0, "issue", "letsencrypt.org"}, {0, "iodef", "mailto:security@example.com"}}},
+		{domain: "*.example.com", name: "example.com", records: []CAARecord{{0, "issue", "letsencrypt.org"}, {0, "iodef", "mailto:security@example.com"}}},
+		{domain: "WWW.Shop.Example.com", name: "shop.example.com", records: []CAARecord{{128, "issue", "pki.goog"}}},
+		{domain: "alias.example.org", name: "alias.example.org", records: []CAARecord{{128, "issue", "pki.goog"}}},
+		{domain: "www.example.org"},
+		{domain: "www.broken.example.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			set, err := LookupCAA(ctx, tt.domain, []string{server})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LookupCAA() = %v, want error", set)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LookupCAA() error = %v", err)
+			}
+			if set.Name != tt.name || !slices.Equal(set.Records, tt.records) {
+				t.Errorf("LookupCAA() = %v %v, want %v %v", set.Name, set.Records, tt.name, tt.records)
+			}
+		})
+	}
+}
+
+func TestCheckMethods(t *testing.T) {
+	records := map[string][]dns.RR{
+		"a.example.com.": {caaRR(t, `a.example.com. 300 IN CAA 0 issue "letsencrypt.org; validationmethods=dns-01,http-01"`)},
+		"b.example.com.": {caaRR(t, `b.example.com. 300 IN CAA 0 issue "letsencrypt.org; validationmethods=http-01"`)},
+		"c.example.com.": {caaRR(t, `c.example.com. 300 IN CAA 0 issue "letsencrypt.org; validationmethods=dns-01"`)},
+	}
+	server := caaServer(t, records)
+	policy := CAAPolicy{Identities: []string{"letsencrypt.org"}, Methods: []string{"dns-01", "http-01"}}
+	ctx := context.Background()
+
+	methods, err := policy.Check(ctx, []string{"a.example.com", "b.example.com", "www.example.com"}, []string{server})
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if !slices.Equal(methods, []string{"http-01"}) {
+		t.Errorf("Check() = %v, want the methods allowed for every domain", methods)
+	}
+
+	if _, err := policy.Check(ctx, []string{"b.example.com", "c.example.com"}, []string{server}); err == nil {
+		t.Error("Check() succeeded without a method allowed for every domain")
+	}
+}
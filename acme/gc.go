@@ -0,0 +1,189 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/DefangLabs/cloudacme/solver"
+	awsalb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+const (
+	// DefaultChallengeMaxAge is well beyond the time an order takes, so rules of a running order are kept
+	DefaultChallengeMaxAge = time.Hour
+	// DefaultTriggerMaxAge leaves a week for the first request to a domain, the next scheduled run sets
+	// up the trigger rule again if the domain still has no certificate
+	DefaultTriggerMaxAge = 7 * 24 * time.Hour
+)
+
+// RuleCollector deletes the listener rules left behind by runs that did not clean up, such as a lambda
+// timing out between presenting and cleaning up a challenge
+type RuleCollector struct {
+	ChallengeMaxAge time.Duration
+	TriggerMaxAge   time.Duration
+	DryRun          bool
+	// IncludeUntagged also deletes untagged fixed response rules on challenge paths, created by versions
+	// of cloudacme before rules were tagged. Their age is unknown, so no order should be running.
+	IncludeUntagged bool
+}
+
+// StaleRule is a listener rule deleted, or to be deleted on a dry run, by the collector
+type StaleRule struct {
+	RuleArn     string
+	ListenerArn string
+	RuleType    string
+	OrderId     string
+	Created     time.Time // zero for untagged rules
+	Conditions  string
+}
+
+// RuleCollectorFromEnv reads ACME_GC_CHALLENGE_MAX_AGE, ACME_GC_TRIGGER_MAX_AGE, ACME_GC_DRY_RUN and
+// ACME_GC_INCLUDE_UNTAGGED, using the defaults for the ages that are not set
+func RuleCollectorFromEnv() (RuleCollector, error) {
+	c := RuleCollector{
+		ChallengeMaxAge: DefaultChallengeMaxAge,
+		TriggerMaxAge:   DefaultTriggerMaxAge,
+		DryRun:          os.Getenv("ACME_GC_DRY_RUN") == "true",
+		IncludeUntagged: os.Getenv("ACME_GC_INCLUDE_UNTAGGED") == "true",
+	}
+	for env, age := range map[string]*time.Duration{
+		"ACME_GC_CHALLENGE_MAX_AGE": &c.ChallengeMaxAge,
+		"ACME_GC_TRIGGER_MAX_AGE":   &c.TriggerMaxAge,
+	} {
+		if s := os.Getenv(env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return c, fmt.Errorf("invalid %v: %w", env, err)
+			}
+			*age = d
+		}
+	}
+	return c, nil
+}
+
+// Collect deletes the stale rules on all listeners of the ALB and returns them
+func (c RuleCollector) Collect(ctx context.Context, albArn string) ([]StaleRule, error) {
+	listeners, err := alb.GetListeners(ctx, albArn, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get listeners of %v: %w", albArn, err)
+	}
+
+	var stale []StaleRule
+	var errs []error
+	now := time.Now()
+	for _, listener := range listeners {
+		rules, err := alb.GetAllRules(ctx, *listener.ListenerArn)
+		if err != nil {
+			return stale, fmt.Errorf("cannot get rules of listener %v: %w", *listener.ListenerArn, err)
+		}
+
+		var ruleArns []string
+		for _, rule := range rules {
+			if !ptr.ToBool(rule.IsDefault) {
+				ruleArns = append(ruleArns, *rule.RuleArn)
+			}
+		}
+		tags, err := alb.GetTags(ctx, ruleArns)
+		if err != nil {
+			return stale, fmt.Errorf("cannot get tags of rules of listener %v: %w", *listener.ListenerArn, err)
+		}
+
+		for _, rule := range rules {
+			if ptr.ToBool(rule.IsDefault) {
+				continue
+			}
+			sr, ok := c.stale(rule, tags[*rule.RuleArn], now)
+			if !ok {
+				continue
+			}
+			sr.ListenerArn = *listener.ListenerArn
+
+			if c.DryRun {
+				log.Printf("Would delete stale %v rule %v (%v), created %v, order %v", sr.RuleType, sr.RuleArn, sr.Conditions, sr.Created, sr.OrderId)
+				stale = append(stale, sr)
+				continue
+			}
+			log.Printf("Deleting stale %v rule %v (%v), created %v, order %v", sr.RuleType, sr.RuleArn, sr.Conditions, sr.Created, sr.OrderId)
+			if err := alb.DeleteRule(ctx, sr.RuleArn); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete rule %v: %w", sr.RuleArn, err))
+				continue
+			}
+			stale = append(stale, sr)
+		}
+	}
+	return stale, errors.Join(errs...)
+}
+
+// stale reports whether the rule was created by cloudacme and is older than the maximum age of its type
+func (c RuleCollector) stale(rule awsalb.Rule, tags map[string]string, now time.Time) (StaleRule, bool) {
+	sr := StaleRule{
+		RuleArn:    *rule.RuleArn,
+		RuleType:   tags[alb.TagRuleType],
+		OrderId:    tags[alb.TagOrderId],
+		Conditions: alb.DescribeConditions(rule),
+	}
+
+	if tags[alb.TagOwner] != alb.OwnerCloudAcme {
+		if c.IncludeUntagged && len(tags) == 0 && isLegacyChallengeRule(rule) {
+			sr.RuleType = alb.RuleTypeChallenge
+			return sr, true
+		}
+		return sr, false
+	}
+
+	var maxAge time.Duration
+	switch sr.RuleType {
+	case alb.RuleTypeChallenge:
+		maxAge = c.ChallengeMaxAge
+	case alb.RuleTypeTrigger:
+		maxAge = c.TriggerMaxAge
+	default:
+		return sr, false // the lambda challenge rule is shared by all orders
+	}
+
+	created, err := time.Parse(time.RFC3339, tags[alb.TagCreated])
+	if err != nil {
+		log.Printf("Rule %v has an invalid %v tag %q, skipping", sr.RuleArn, alb.TagCreated, tags[alb.TagCreated])
+		return sr, false
+	}
+	sr.Created = created
+	return sr, now.Sub(created) > maxAge
+}
+
+// isLegacyChallengeRule reports whether the rule has the shape of the rules created by the ALB solver before
+// rules were tagged: a 200 text/plain fixed response, a host header condition and a path condition on
+// challenge paths without wildcards, and no other condition
+func isLegacyChallengeRule(rule awsalb.Rule) bool {
+	if ptr.ToBool(rule.IsDefault) || len(rule.Actions) != 1 || rule.Actions[0].Type != awsalb.ActionTypeEnumFixedResponse {
+		return false
+	}
+	fr := rule.Actions[0].FixedResponseConfig
+	if fr == nil || ptr.ToString(fr.StatusCode) != "200" || ptr.ToString(fr.ContentType) != "text/plain" {
+		return false
+	}
+	var hasHost, hasPath bool
+	for _, cond := range rule.Conditions {
+		switch {
+		case cond.HostHeaderConfig != nil && !hasHost:
+			hasHost = true
+		case cond.PathPatternConfig != nil && !hasPath:
+			hasPath = len(cond.PathPatternConfig.Values) > 0 && !slices.ContainsFunc(cond.PathPatternConfig.Values, func(p string) bool {
+				return !strings.HasPrefix(p, solver.ChallengePathPrefix) || strings.ContainsAny(p, "*?")
+			})
+			if !hasPath {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return hasHost && hasPath
+}
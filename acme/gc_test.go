@@ -0,0 +1,120 @@
+package acme
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	awsalb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+func fixedResponse(status, contentType string) awsalb.Action {
+	return awsalb.Action{
+		Type: awsalb.ActionTypeEnumFixedResponse,
+		FixedResponseConfig: &awsalb.FixedResponseActionConfig{
+			StatusCode:  ptr.String(status),
+			ContentType: ptr.String(contentType),
+			MessageBody: ptr.String("token.thumbprint"),
+		},
+	}
+}
+
+func gcRule(actions []awsalb.Action, conds ...awsalb.RuleCondition) awsalb.Rule {
+	return awsalb.Rule{RuleArn: ptr.String("rule"), Priority: ptr.String("1"), Actions: actions, Conditions: conds}
+}
+
+func hostIs(values ...string) awsalb.RuleCondition {
+	return awsalb.RuleCondition{Field: ptr.String("host-header"), HostHeaderConfig: &awsalb.HostHeaderConditionConfig{Values: values}}
+}
+
+func pathIs(values ...string) awsalb.RuleCondition {
+	return awsalb.RuleCondition{Field: ptr.String("path-pattern"), PathPatternConfig: &awsalb.PathPatternConditionConfig{Values: values}}
+}
+
+func TestIsLegacyChallengeRule(t *testing.T) {
+	challenge := []awsalb.Action{fixedResponse("200", "text/plain")}
+	forward := []awsalb.Action{{Type: awsalb.ActionTypeEnumForward, TargetGroupArn: ptr.String("tg")}}
+	host := hostIs("www.example.com")
+	path := pathIs("/.well-known/acme-challenge/abc")
+
+	tests := []struct {
+		name string
+		rule awsalb.Rule
+		want bool
+	}{
+		{"challenge rule", gcRule(challenge, path, host), true},
+		{"several challenge paths", gcRule(challenge, host, pathIs("/.well-known/acme-challenge/abc", "/.well-known/acme-challenge/def")), true},
+		{"no host", gcRule(challenge, path), false},
+		{"no path", gcRule(challenge, host), false},
+		{"wildcard challenge path", gcRule(challenge, host, pathIs("/.well-known/acme-challenge/*")), false},
+		{"single character wildcard", gcRule(challenge, host, pathIs("/.well-known/acme-challenge/ab?")), false},
+		{"other path", gcRule(challenge, host, pathIs("/healthz")), false},
+		{"challenge and other path", gcRule(challenge, host, pathIs("/.well-known/acme-challenge/abc", "/healthz")), false},
+		{"well-known path", gcRule(challenge, host, pathIs("/.well-known/security.txt")), false},
+		{"forward", gcRule(forward, host, path), false},
+		{"two actions", gcRule(append(challenge, forward...), host, path), false},
+		{"not found response", gcRule([]awsalb.Action{fixedResponse("404", "text/plain")}, host, path), false},
+		{"json response", gcRule([]awsalb.Action{fixedResponse("200", "application/json")}, host, path), false},
+		{"additional source ip", gcRule(challenge, host, path, awsalb.RuleCondition{Field: ptr.String("source-ip"), SourceIpConfig: &awsalb.SourceIpConditionConfig{Values: []string{"10.0.0.0/8"}}}), false},
+		{"additional header", gcRule(challenge, host, path, awsalb.RuleCondition{Field: ptr.String("http-header"), HttpHeaderConfig: &awsalb.HttpHeaderConditionConfig{HttpHeaderName: ptr.String("X-Test"), Values: []string{"1"}}}), false},
+		{"two path conditions", gcRule(challenge, host, path, pathIs("/healthz")), false},
+		{"default rule", awsalb.Rule{RuleArn: ptr.String("default"), IsDefault: ptr.Bool(true), Actions: challenge}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLegacyChallengeRule(tt.rule); got != tt.want {
+				t.Errorf("isLegacyChallengeRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	legacy := gcRule([]awsalb.Action{fixedResponse("200", "text/plain")}, hostIs("www.example.com"), pathIs("/.well-known/acme-challenge/abc"))
+	customer := gcRule([]awsalb.Action{{Type: awsalb.ActionTypeEnumForward, TargetGroupArn: ptr.String("tg")}}, hostIs("www.example.com"))
+	tags := func(ruleType string, age time.Duration) map[string]string {
+		return map[string]string{
+			alb.TagOwner:    alb.OwnerCloudAcme,
+			alb.TagRuleType: ruleType,
+			alb.TagCreated:  now.Add(-age).Format(time.RFC3339),
+			alb.TagOrderId:  "0123456789abcdef",
+		}
+	}
+	collector := RuleCollector{ChallengeMaxAge: time.Hour, TriggerMaxAge: 7 * 24 * time.Hour}
+	withUntagged := collector
+	withUntagged.IncludeUntagged = true
+
+	tests := []struct {
+		name      string
+		collector RuleCollector
+		rule      awsalb.Rule
+		tags      map[string]string
+		want      bool
+	}{
+		{"old challenge", collector, legacy, tags(alb.RuleTypeChallenge, 2*time.Hour), true},
+		{"recent challenge", collector, legacy, tags(alb.RuleTypeChallenge, 30*time.Minute), false},
+		{"old trigger", collector, customer, tags(alb.RuleTypeTrigger, 8*24*time.Hour), true},
+		{"recent trigger", collector, customer, tags(alb.RuleTypeTrigger, 2*time.Hour), false},
+		{"lambda challenge never stale", collector, legacy, tags(alb.RuleTypeLambdaChallenge, 365*24*time.Hour), false},
+		{"unknown rule type", collector, legacy, tags("other", 365*24*time.Hour), false},
+		{"invalid created tag", collector, legacy, map[string]string{alb.TagOwner: alb.OwnerCloudAcme, alb.TagRuleType: alb.RuleTypeChallenge, alb.TagCreated: "yesterday"}, false},
+		{"other owner", collector, legacy, map[string]string{alb.TagOwner: "someone", alb.TagRuleType: alb.RuleTypeChallenge, alb.TagCreated: now.Add(-48 * time.Hour).Format(time.RFC3339)}, false},
+		{"untagged customer rule", withUntagged, customer, nil, false},
+		{"untagged legacy challenge without include", collector, legacy, nil, false},
+		{"untagged legacy challenge", withUntagged, legacy, nil, true},
+		{"legacy challenge with customer tags", withUntagged, legacy, map[string]string{"team": "web"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, got := tt.collector.stale(tt.rule, tt.tags, now)
+			if got != tt.want {
+				t.Errorf("stale() = %v, want %v", got, tt.want)
+			}
+			if got && sr.RuleType != alb.RuleTypeChallenge && sr.RuleType != alb.RuleTypeTrigger {
+				t.Errorf("stale rule type = %q", sr.RuleType)
+			}
+		})
+	}
+}
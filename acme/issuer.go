@@ -0,0 +1,215 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DefangLabs/cloudacme/aws/acm"
+)
+
+// TagIssuerKeyId records the authority key id of the certificate cloudacme imported, so a certificate
+// issued through cloudacme is recognized as long as ACM still holds that certificate.
+const TagIssuerKeyId = "cloudacme:issuer-key-id"
+
+const LetsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// CertificateOrigin is who issued a certificate found on the load balancer
+type CertificateOrigin int
+
+const (
+	OriginOther       CertificateOrigin = iota // another CA, the certificate is replaced on the initial run
+	OriginPlaceholder                          // self signed placeholder waiting for the initial run
+	OriginIssued                               // issued by the configured ACME CA, renewed when due
+)
+
+func (o CertificateOrigin) String() string {
+	switch o {
+	case OriginPlaceholder:
+		return "placeholder"
+	case OriginIssued:
+		return "issued"
+	default:
+		return "other"
+	}
+}
+
+// knownIntermediate names the intermediates of an ACME CA, a certificate is only recognized by name when
+// its chain verifies against the system roots so that the names cannot be copied into another certificate.
+// The Let's Encrypt staging intermediates are not listed, their roots are not system roots, so staging
+// certificates are only recognized by the TagIssuerKeyId tag or ACME_ISSUER_KEY_IDS.
+type knownIntermediate struct {
+	Organization string
+	CommonNames  []string
+}
+
+var knownIntermediates = map[string]knownIntermediate{
+	LetsEncryptDirectory: {
+		Organization: "Let's Encrypt",
+		CommonNames:  []string{"R10", "R11", "R12", "R13", "R14", "E5", "E6", "E7", "E8", "E9"},
+	},
+}
+
+// IssuerRecognizer decides whether a certificate was issued by the CA of Directory
+type IssuerRecognizer struct {
+	Directory string
+	KeyIds    []string // subject key ids of the CA intermediates, in hex
+}
+
+// DirectoryFromEnv returns the ACME directory in ACME_DIRECTORY, or DefaultAcmeDirectory when it is not set
+func DirectoryFromEnv() string {
+	if directory := os.Getenv("ACME_DIRECTORY"); directory != "" {
+		return directory
+	}
+	return DefaultAcmeDirectory
+}
+
+// IssuerRecognizerFromEnv recognizes the CA of ACME_DIRECTORY, along with the intermediates whose subject
+// key ids are listed in the comma separated ACME_ISSUER_KEY_IDS.
+func IssuerRecognizerFromEnv() IssuerRecognizer {
+	r := IssuerRecognizer{Directory: DirectoryFromEnv()}
+	for _, id := range strings.Split(os.Getenv("ACME_ISSUER_KEY_IDS"), ",") {
+		if id = normalizeKeyId(id); id != "" {
+			r.KeyIds = append(r.KeyIds, id)
+		}
+	}
+	return r
+}
+
+// Recognize classifies the certificate imported in certArn using its tags and the chain stored in ACM
+func (r IssuerRecognizer) Recognize(ctx context.Context, certArn string, cert *x509.Certificate) (CertificateOrigin, error) {
+	tags, err := acm.ListTags(ctx, certArn)
+	if err != nil {
+		return OriginOther, fmt.Errorf("failed to list tags of %v: %w", certArn, err)
+	}
+	chainPem, err := acm.GetCertificateChain(ctx, certArn)
+	if err != nil {
+		return OriginOther, fmt.Errorf("failed to get certificate chain of %v: %w", certArn, err)
+	}
+	intermediates, err := parseCertificates(chainPem)
+	if err != nil {
+		return OriginOther, fmt.Errorf("failed to parse certificate chain of %v: %w", certArn, err)
+	}
+
+	origin, reason := r.Classify(cert, tags, intermediates)
+	log.Printf("Certificate %v is %v: %v", certArn, origin, reason)
+	return origin, nil
+}
+
+// Classify returns the origin of cert and the reason for it
+func (r IssuerRecognizer) Classify(cert *x509.Certificate, tags map[string]string, intermediates []*x509.Certificate) (CertificateOrigin, string) {
+	if IsSelfSigned(cert) {
+		return OriginPlaceholder, "self signed"
+	}
+	if tags[TagPlaceholder] == "true" {
+		return OriginPlaceholder, "tagged " + TagPlaceholder
+	}
+
+	keyId := hex.EncodeToString(cert.AuthorityKeyId)
+	if keyId != "" && tags[TagIssuerKeyId] == keyId {
+		return OriginIssued, "imported by cloudacme, tagged " + TagIssuerKeyId
+	}
+	if keyId != "" && slices.Contains(r.KeyIds, keyId) {
+		return OriginIssued, "authority key id " + keyId + " is a configured issuer"
+	}
+	if issuer := r.verifiedIntermediate(cert, intermediates); issuer != nil {
+		return OriginIssued, "issued by known intermediate " + issuer.Subject.CommonName
+	}
+	return OriginOther, fmt.Sprintf("issuer %q is not recognized for %v", cert.Issuer, r.Directory)
+}
+
+// verifiedIntermediate returns the intermediate that issued cert, when it is a known intermediate of the
+// directory and the chain verifies against the system roots
+func (r IssuerRecognizer) verifiedIntermediate(cert *x509.Certificate, intermediates []*x509.Certificate) *x509.Certificate {
+	known, ok := knownIntermediates[r.Directory]
+	if !ok || len(intermediates) == 0 {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	for _, c := range intermediates {
+		pool.AddCert(c)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Intermediates: pool,
+		CurrentTime:   cert.NotBefore, // an expired certificate is still recognized so that it is renewed
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil
+	}
+	for _, chain := range chains {
+		if len(chain) < 2 {
+			continue
+		}
+		issuer := chain[1]
+		if slices.Contains(issuer.Subject.Organization, known.Organization) && slices.Contains(known.CommonNames, issuer.Subject.CommonName) {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// IsSelfSigned reports whether cert is signed by its own key, as the placeholder certificates are
+func IsSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) > 0 && len(cert.SubjectKeyId) > 0 && !bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId) {
+		return false
+	}
+	// CheckSignatureFrom would reject leaf certificates that are not marked as a CA
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// tagIssuer records the authority key id of the leaf of chain on certArn, and removes the placeholder
+// tag once a CA issued certificate replaced the placeholder. Failures are logged only as the tags only
+// help recognizing the certificate later.
+func tagIssuer(ctx context.Context, certArn string, chain []byte) {
+	certs, err := parseCertificates(chain)
+	if err != nil || len(certs) == 0 {
+		log.Printf("Failed to parse certificate imported into %v: %v", certArn, err)
+		return
+	}
+	leaf := certs[0]
+	if IsSelfSigned(leaf) || len(leaf.AuthorityKeyId) == 0 {
+		return
+	}
+	if err := acm.AddTags(ctx, certArn, map[string]string{TagIssuerKeyId: hex.EncodeToString(leaf.AuthorityKeyId)}); err != nil {
+		log.Printf("Failed to tag %v with its issuer: %v", certArn, err)
+	}
+	if err := acm.RemoveTags(ctx, certArn, TagPlaceholder); err != nil {
+		log.Printf("Failed to remove placeholder tag of %v: %v", certArn, err)
+	}
+}
+
+func parseCertificates(chainPem []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, chainPem = pem.Decode(chainPem)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// normalizeKeyId accepts key ids as printed by openssl, such as "BB:BC:...", or plain hex
+func normalizeKeyId(id string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(id), ":", ""))
+}
@@ -0,0 +1,113 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const letsEncryptStagingDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// issueCertificate creates a certificate for template signed by parent, or self signed when parent is nil
+func issueCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func caTemplate(org, cn string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{org}, CommonName: cn},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// a chain that names a Let's Encrypt intermediate but does not verify against the system roots
+	root, rootKey := issueCertificate(t, caTemplate("Internet Security Research Group", "ISRG Root X1"), nil, nil)
+	intermediate, intermediateKey := issueCertificate(t, caTemplate("Let's Encrypt", "R10"), root, rootKey)
+	leaf, _ := issueCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"example.com"}}, intermediate, intermediateKey)
+	keyId := hex.EncodeToString(leaf.AuthorityKeyId)
+
+	_, placeholderChain, err := CreatePlaceholderCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholders, err := parseCertificates(placeholderChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholder := placeholders[0]
+
+	production := IssuerRecognizer{Directory: LetsEncryptDirectory}
+	staging := IssuerRecognizer{Directory: letsEncryptStagingDirectory}
+
+	tests := []struct {
+		name          string
+		recognizer    IssuerRecognizer
+		cert          *x509.Certificate
+		tags          map[string]string
+		intermediates []*x509.Certificate
+		want          CertificateOrigin
+	}{
+		{"self signed", production, placeholder, nil, nil, OriginPlaceholder},
+		{"self signed with issuer tag", production, placeholder, map[string]string{TagIssuerKeyId: keyId}, nil, OriginPlaceholder},
+		{"tagged placeholder", production, leaf, map[string]string{TagPlaceholder: "true"}, nil, OriginPlaceholder},
+		{"issuer tag", production, leaf, map[string]string{TagIssuerKeyId: keyId}, nil, OriginIssued},
+		{"issuer tag of another issuer", production, leaf, map[string]string{TagIssuerKeyId: "0102"}, nil, OriginOther},
+		{"configured key id", IssuerRecognizer{Directory: LetsEncryptDirectory, KeyIds: []string{"0102", keyId}}, leaf, nil, nil, OriginIssued},
+		{"intermediate names without a trusted root", production, leaf, nil, []*x509.Certificate{intermediate}, OriginOther},
+		{"intermediate names with the root in the chain", production, leaf, nil, []*x509.Certificate{intermediate, root}, OriginOther},
+		{"no chain", production, leaf, nil, nil, OriginOther},
+		{"staging not recognized by chain", staging, leaf, nil, []*x509.Certificate{intermediate}, OriginOther},
+		{"staging issuer tag", staging, leaf, map[string]string{TagIssuerKeyId: keyId}, nil, OriginIssued},
+		{"staging configured key id", IssuerRecognizer{Directory: letsEncryptStagingDirectory, KeyIds: []string{keyId}}, leaf, nil, nil, OriginIssued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.recognizer.Classify(tt.cert, tt.tags, tt.intermediates)
+			if got != tt.want {
+				t.Errorf("Classify() = %v (%v), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssuerRecognizerFromEnv(t *testing.T) {
+	t.Setenv("ACME_DIRECTORY", letsEncryptStagingDirectory)
+	t.Setenv("ACME_ISSUER_KEY_IDS", "BB:BC:0A:01 , ,0102ab")
+	r := IssuerRecognizerFromEnv()
+	if r.Directory != letsEncryptStagingDirectory {
+		t.Errorf("Directory = %v, want %v", r.Directory, letsEncryptStagingDirectory)
+	}
+	if len(r.KeyIds) != 2 || r.KeyIds[0] != "bbbc0a01" || r.KeyIds[1] != "0102ab" {
+		t.Errorf("KeyIds = %v, want [bbbc0a01 0102ab]", r.KeyIds)
+	}
+}
@@ -0,0 +1,68 @@
+package acme
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRenewBefore renews once a third of the certificate lifetime is left, 30 days for 90 day certificates
+const DefaultRenewBefore = "0.33"
+
+// RenewalThreshold is how long before expiry a certificate is renewed, either a number of days or a fraction
+// of the certificate lifetime.
+type RenewalThreshold struct {
+	Days     int
+	Fraction float64
+}
+
+// ParseRenewalThreshold parses a number of days, such as "30d", or a fraction of the lifetime, such as "0.33" or "33%"
+func ParseRenewalThreshold(s string) (RenewalThreshold, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return RenewalThreshold{}, fmt.Errorf("invalid number of days %q", s)
+		}
+		return RenewalThreshold{Days: n}, nil
+	}
+
+	percent, isPercent := strings.CutSuffix(s, "%")
+	f, err := strconv.ParseFloat(percent, 64)
+	if err != nil {
+		return RenewalThreshold{}, fmt.Errorf("invalid renewal threshold %q, expected days such as 30d or a fraction such as 0.33", s)
+	}
+	if isPercent {
+		f /= 100
+	}
+	if f <= 0 || f >= 1 {
+		return RenewalThreshold{}, fmt.Errorf("renewal threshold fraction %q must be between 0 and 1", s)
+	}
+	return RenewalThreshold{Fraction: f}, nil
+}
+
+// RenewalThresholdFromEnv parses ACME_RENEW_BEFORE, or DefaultRenewBefore when it is not set
+func RenewalThresholdFromEnv() (RenewalThreshold, error) {
+	s := os.Getenv("ACME_RENEW_BEFORE")
+	if s == "" {
+		s = DefaultRenewBefore
+	}
+	return ParseRenewalThreshold(s)
+}
+
+// RenewAt returns the time from which the certificate is due for renewal
+func (t RenewalThreshold) RenewAt(cert *x509.Certificate) time.Time {
+	if t.Days > 0 {
+		return cert.NotAfter.Add(-time.Duration(t.Days) * 24 * time.Hour)
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Add(-time.Duration(float64(lifetime) * t.Fraction))
+}
+
+// ShouldRenew reports whether the certificate is due for renewal at now
+func (t RenewalThreshold) ShouldRenew(cert *x509.Certificate, now time.Time) bool {
+	return !now.Before(t.RenewAt(cert))
+}
@@ -0,0 +1,79 @@
+package acme
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestParseRenewalThreshold(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RenewalThreshold
+		wantErr bool
+	}{
+		{in: "30d", want: RenewalThreshold{Days: 30}},
+		{in: " 7d ", want: RenewalThreshold{Days: 7}},
+		{in: "0.33", want: RenewalThreshold{Fraction: 0.33}},
+		{in: "33%", want: RenewalThreshold{Fraction: 0.33}},
+		{in: DefaultRenewBefore, want: RenewalThreshold{Fraction: 0.33}},
+		{in: "0d", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "1", wantErr: true},
+		{in: "100%", wantErr: true},
+		{in: "30", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRenewalThreshold(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRenewalThreshold(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRenewalThreshold(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRenewalThreshold(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenewAt(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert90 := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+	cert6 := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(6 * 24 * time.Hour)}
+
+	tests := []struct {
+		name      string
+		threshold RenewalThreshold
+		cert      *x509.Certificate
+		want      time.Time
+	}{
+		{"days", RenewalThreshold{Days: 30}, cert90, notBefore.Add(60 * 24 * time.Hour)},
+		{"third of 90 days", RenewalThreshold{Fraction: 1.0 / 3}, cert90, notBefore.Add(60 * 24 * time.Hour)},
+		{"half of 6 days", RenewalThreshold{Fraction: 0.5}, cert6, notBefore.Add(3 * 24 * time.Hour)},
+		{"more days than the lifetime", RenewalThreshold{Days: 30}, cert6, cert6.NotAfter.Add(-30 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.threshold.RenewAt(tt.cert)
+			if d := got.Sub(tt.want).Abs(); d > time.Second {
+				t.Errorf("RenewAt() = %v, want %v", got, tt.want)
+			}
+			if tt.threshold.ShouldRenew(tt.cert, got.Add(-time.Minute)) {
+				t.Errorf("ShouldRenew() before %v = true", got)
+			}
+			if !tt.threshold.ShouldRenew(tt.cert, got) {
+				t.Errorf("ShouldRenew() at %v = false", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/DefangLabs/cloudacme/aws/acm"
+)
+
+// RegionError is the failure to import a certificate into one region
+type RegionError struct {
+	Region string
+	Err    error
+}
+
+func (e RegionError) Error() string {
+	return fmt.Sprintf("region %v: %v", e.Region, e.Err)
+}
+
+func (e RegionError) Unwrap() error {
+	return e.Err
+}
+
+// ReplicaRegionsFromEnv returns the regions in the comma separated ACME_REPLICA_REGIONS environment variable
+func ReplicaRegionsFromEnv() []string {
+	return ParseRegions(os.Getenv("ACME_REPLICA_REGIONS"))
+}
+
+// ParseRegions returns the regions in a comma separated list
+func ParseRegions(s string) []string {
+	return splitList(s)
+}
+
+// ReplicateCertificate imports the certificate into ACM in each of the regions. The certificate created for
+// domain in a region by an earlier replication is found by its tags and reimported, so its ARN stays the same.
+// The certificates are only imported, attaching a new one to the load balancers of a region is left to the user.
+// The ARNs of the regions that succeeded are returned along with a RegionError for each region that failed.
+func ReplicateCertificate(ctx context.Context, history CertificateHistory, regions []string, domain string, key crypto.Signer, chain []byte) (map[string]string, error) {
+	certArns := make(map[string]string, len(regions))
+	var errs []error
+	for _, region := range regions {
+		certArn, err := replicateToRegion(ctx, history, region, domain, key, chain)
+		if err != nil {
+			log.Printf("Failed to replicate certificate for %v to %v: %v", domain, region, err)
+			errs = append(errs, RegionError{Region: region, Err: err})
+			continue
+		}
+		log.Printf("Replicated certificate for %v to %v as %v", domain, region, certArn)
+		certArns[region] = certArn
+	}
+	return certArns, errors.Join(errs...)
+}
+
+func replicateToRegion(ctx context.Context, history CertificateHistory, region, domain string, key crypto.Signer, chain []byte) (string, error) {
+	certArn, err := acm.FindImportedCertificateByTags(ctx, region, ManagedCertificateTags(domain, TargetReplica))
+	if err != nil {
+		return "", fmt.Errorf("failed to find certificate by tags: %w", err)
+	}
+	return ImportCertificate(ctx, history, region, key, chain, certArn, ManagedCertificateTags(domain, TargetReplica))
+}
@@ -0,0 +1,246 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DefangLabs/cloudacme/aws/acm"
+	"github.com/DefangLabs/cloudacme/aws/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const DefaultCertificateHistoryPrefix = "/cloudacme/certificates"
+
+var ErrNoPreviousCertificate = errors.New("no previous certificate to roll back to")
+
+// StoredCertificate is a certificate chain and its private key as imported into ACM.
+type StoredCertificate struct {
+	Key        crypto.Signer
+	Chain      []byte
+	Leaf       *x509.Certificate
+	Version    int64 // identifies the entry in the history
+	RolledBack bool  // the certificate was rolled back from, it is not restored again
+}
+
+// CertificateHistory keeps the certificates imported into an ACM certificate ARN so a reimport can be undone.
+type CertificateHistory interface {
+	Save(ctx context.Context, certArn string, key crypto.Signer, chain []byte) error
+	// List returns the saved certificates for certArn, oldest first
+	List(ctx context.Context, certArn string) ([]StoredCertificate, error)
+	// MarkRolledBack records that the saved certificate was rolled back from
+	MarkRolledBack(ctx context.Context, certArn string, sc StoredCertificate) error
+}
+
+// rolledBackLabelPrefix starts the label of the parameter versions that were rolled back from, a label can
+// only be attached to one version so the version number is part of it
+const rolledBackLabelPrefix = "rolled-back-"
+
+// SSMCertificateHistory stores one SecureString parameter per certificate ARN, every import adds a
+// new parameter version and SSM retains the older ones. The versions rolled back from are labeled.
+type SSMCertificateHistory struct {
+	Prefix   string
+	KmsKeyId string
+}
+
+func (s SSMCertificateHistory) Save(ctx context.Context, certArn string, key crypto.Signer, chain []byte) error {
+	value, err := encodeStoredCertificate(key, chain)
+	if err != nil {
+		return err
+	}
+	return ssm.PutSecureParameter(ctx, s.parameterName(certArn), value, s.KmsKeyId)
+}
+
+func (s SSMCertificateHistory) List(ctx context.Context, certArn string) ([]StoredCertificate, error) {
+	versions, err := ssm.GetParameterHistory(ctx, s.parameterName(certArn))
+	var notFoundErr *types.ParameterNotFound
+	if errors.As(err, &notFoundErr) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	stored := make([]StoredCertificate, 0, len(versions))
+	for _, v := range versions {
+		sc, err := decodeStoredCertificate([]byte(v.Value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode version %d of %v: %w", v.Version, certArn, err)
+		}
+		sc.Version = v.Version
+		sc.RolledBack = slices.ContainsFunc(v.Labels, func(l string) bool { return strings.HasPrefix(l, rolledBackLabelPrefix) })
+		stored = append(stored, sc)
+	}
+	return stored, nil
+}
+
+func (s SSMCertificateHistory) MarkRolledBack(ctx context.Context, certArn string, sc StoredCertificate) error {
+	return ssm.LabelParameterVersion(ctx, s.parameterName(certArn), sc.Version, fmt.Sprintf("%v%d", rolledBackLabelPrefix, sc.Version))
+}
+
+// parameterName uses the certificate id, the last part of the ARN, as ':' is not allowed in parameter names
+func (s SSMCertificateHistory) parameterName(certArn string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultCertificateHistoryPrefix
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + certArn[strings.LastIndex(certArn, "/")+1:]
+}
+
+// CertificateHistoryFromEnv returns the history configured by ACME_CERT_HISTORY_SSM_PREFIX, or nil when
+// certificate history is not enabled.
+func CertificateHistoryFromEnv() CertificateHistory {
+	prefix := os.Getenv("ACME_CERT_HISTORY_SSM_PREFIX")
+	if prefix == "" {
+		return nil
+	}
+	return SSMCertificateHistory{Prefix: prefix, KmsKeyId: os.Getenv("ACME_CERT_HISTORY_KMS_KEY_ID")}
+}
+
+// ImportCertificate imports the certificate into ACM and records it in history, when history is not nil,
+// so that it can be restored by RollbackCertificate after a later reimport. A new certificate is created
+// in region, or the default region when empty, with the given tags when certArn is empty. A failure to record
+// it in history is logged, the imported certificate ARN is still returned.
+func ImportCertificate(ctx context.Context, history CertificateHistory, region string, key crypto.Signer, chain []byte, certArn string, tags map[string]string) (string, error) {
+	if history != nil && certArn != "" {
+		if err := checkCurrentCertificateSaved(ctx, history, certArn); err != nil {
+			log.Printf("Previous certificate of %v cannot be rolled back to: %v", certArn, err)
+		}
+	}
+
+	certArn, err := acm.ImportCertificate(ctx, region, key, chain, certArn, tags)
+	if err != nil {
+		return "", err
+	}
+	tagIssuer(ctx, certArn, chain)
+
+	if history != nil {
+		// The certificate is in use already, failing here would have it imported again by a retry
+		if err := history.Save(ctx, certArn, key, chain); err != nil {
+			log.Printf("Certificate %v imported but not saved to history, it cannot be rolled back to: %v", certArn, err)
+		}
+	}
+	return certArn, nil
+}
+
+// RollbackCertificate reimports the most recently saved certificate that differs from the one currently in ACM
+// and was not rolled back from. The current certificate is marked as rolled back from, so that a second
+// rollback restores the certificate before the restored one rather than the current one again.
+func RollbackCertificate(ctx context.Context, history CertificateHistory, certArn string) error {
+	current, err := GetAcmCertificate(ctx, certArn)
+	if err != nil {
+		return fmt.Errorf("failed to get current certificate: %w", err)
+	}
+
+	saved, err := history.List(ctx, certArn)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate history: %w", err)
+	}
+
+	previous, discarded, ok := previousCertificate(saved, current)
+	if !ok {
+		return ErrNoPreviousCertificate
+	}
+	log.Printf("Rolling back %v to certificate with serial %v expiring %v", certArn, previous.Leaf.SerialNumber, previous.Leaf.NotAfter)
+	if _, err := acm.ImportCertificate(ctx, "", previous.Key, previous.Chain, certArn, nil); err != nil {
+		return fmt.Errorf("failed to reimport previous certificate: %w", err)
+	}
+	tagIssuer(ctx, certArn, previous.Chain)
+
+	for _, sc := range discarded {
+		if err := history.MarkRolledBack(ctx, certArn, sc); err != nil {
+			return fmt.Errorf("certificate rolled back but not marked as rolled back from in history: %w", err)
+		}
+	}
+	return nil
+}
+
+// previousCertificate returns the most recently saved certificate to roll back to from current, skipping the
+// certificates already rolled back from, and the saved entries of current that are rolled back from
+func previousCertificate(saved []StoredCertificate, current *x509.Certificate) (StoredCertificate, []StoredCertificate, bool) {
+	var discarded []StoredCertificate
+	for _, sc := range saved {
+		if !sc.RolledBack && bytes.Equal(sc.Leaf.Raw, current.Raw) {
+			discarded = append(discarded, sc)
+		}
+	}
+	for i := len(saved) - 1; i >= 0; i-- {
+		if saved[i].RolledBack || bytes.Equal(saved[i].Leaf.Raw, current.Raw) {
+			continue
+		}
+		return saved[i], discarded, true
+	}
+	return StoredCertificate{}, nil, false
+}
+
+// checkCurrentCertificateSaved verifies the certificate about to be replaced has its key in history,
+// which is not the case for certificates imported by other means, such as the self signed placeholder.
+func checkCurrentCertificateSaved(ctx context.Context, history CertificateHistory, certArn string) error {
+	current, err := GetAcmCertificate(ctx, certArn)
+	if err != nil {
+		return err
+	}
+	saved, err := history.List(ctx, certArn)
+	if err != nil {
+		return err
+	}
+	for _, sc := range saved {
+		if bytes.Equal(sc.Leaf.Raw, current.Raw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate with serial %v was not imported by cloudacme, its private key is not available", current.SerialNumber)
+}
+
+// GetAcmCertificate returns the leaf certificate of certArn
+func GetAcmCertificate(ctx context.Context, certArn string) (*x509.Certificate, error) {
+	certPem, err := acm.GetCertificate(ctx, certArn)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode certificate pem for %v", certArn)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func encodeStoredCertificate(key crypto.Signer, chain []byte) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal certificate key: %w", err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return string(keyPem) + string(chain), nil
+}
+
+func decodeStoredCertificate(data []byte) (StoredCertificate, error) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return StoredCertificate{}, errors.New("missing private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return StoredCertificate{}, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return StoredCertificate{}, fmt.Errorf("unsupported private key type %T", key)
+	}
+	leafBlock, _ := pem.Decode(rest)
+	if leafBlock == nil {
+		return StoredCertificate{}, errors.New("missing certificate")
+	}
+	leaf, err := x509.ParseCertificate(leafBlock.Bytes)
+	if err != nil {
+		return StoredCertificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return StoredCertificate{Key: signer, Chain: rest, Leaf: leaf}, nil
+}
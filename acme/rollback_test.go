@@ -0,0 +1,101 @@
+package acme
+
+import (
+	"crypto/x509"
+	"slices"
+	"testing"
+)
+
+func TestPreviousCertificate(t *testing.T) {
+	certA := &x509.Certificate{Raw: []byte("a")}
+	certB := &x509.Certificate{Raw: []byte("b")}
+	certC := &x509.Certificate{Raw: []byte("c")}
+	certD := &x509.Certificate{Raw: []byte("d")}
+	saved := func(leaf *x509.Certificate, version int64, rolledBack bool) StoredCertificate {
+		return StoredCertificate{Leaf: leaf, Version: version, RolledBack: rolledBack}
+	}
+
+	tests := []struct {
+		name      string
+		saved     []StoredCertificate
+		current   *x509.Certificate
+		want      int64
+		discarded []int64
+		ok        bool
+	}{
+		{
+			name:      "restores the previous certificate",
+			saved:     []StoredCertificate{saved(certA, 1, false), saved(certB, 2, false)},
+			current:   certB,
+			want:      1,
+			discarded: []int64{2},
+			ok:        true,
+		},
+		{
+			name:      "second rollback goes further back",
+			saved:     []StoredCertificate{saved(certA, 1, false), saved(certB, 2, false), saved(certC, 3, true)},
+			current:   certB,
+			want:      1,
+			discarded: []int64{2},
+			ok:        true,
+		},
+		{
+			name:      "renewal after a rollback skips the certificate rolled back from",
+			saved:     []StoredCertificate{saved(certA, 1, false), saved(certB, 2, false), saved(certC, 3, true), saved(certD, 4, false)},
+			current:   certD,
+			want:      2,
+			discarded: []int64{4},
+			ok:        true,
+		},
+		{
+			name:      "current certificate saved more than once",
+			saved:     []StoredCertificate{saved(certA, 1, false), saved(certB, 2, false), saved(certB, 3, false)},
+			current:   certB,
+			want:      1,
+			discarded: []int64{2, 3},
+			ok:        true,
+		},
+		{
+			name:    "current certificate not in history",
+			saved:   []StoredCertificate{saved(certA, 1, false)},
+			current: certB,
+			want:    1,
+			ok:      true,
+		},
+		{
+			name:    "only the current certificate",
+			saved:   []StoredCertificate{saved(certA, 1, false)},
+			current: certA,
+		},
+		{
+			name:    "everything else rolled back from",
+			saved:   []StoredCertificate{saved(certA, 1, true), saved(certB, 2, false)},
+			current: certB,
+		},
+		{
+			name:    "empty history",
+			current: certA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, discarded, ok := previousCertificate(tt.saved, tt.current)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got.Version != tt.want {
+				t.Errorf("restored version %d, want %d", got.Version, tt.want)
+			}
+			var versions []int64
+			for _, sc := range discarded {
+				versions = append(versions, sc.Version)
+			}
+			if !slices.Equal(versions, tt.discarded) {
+				t.Errorf("discarded versions %v, want %v", versions, tt.discarded)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package acme
 
 import (
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -9,16 +10,37 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/DefangLabs/cloudacme/aws/acm"
 	"github.com/DefangLabs/cloudacme/aws/alb"
 	awsalb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/ptr"
 	"github.com/mholt/acmez"
 	"go.uber.org/zap"
 )
 
+const (
+	TagManaged = "cloudacme:managed"
+	TagDomain  = "cloudacme:domain"
+	TagTarget  = "cloudacme:target"
+)
+
+// The targets a managed certificate is imported for, as tagged with TagTarget, so that the certificates of
+// the same domain for different targets are not taken for one another
+const (
+	TargetAlb        = "alb"
+	TargetCloudFront = "cloudfront"
+	TargetApiGateway = "apigateway"
+	TargetReplica    = "replica"
+)
+
+var ErrCertificateNotFound = errors.New("no matching certificate found")
+
 var logger *zap.Logger
 
 func init() {
@@ -29,47 +51,133 @@ func init() {
 	}
 }
 
-func UpdateAcmeCertificate(ctx context.Context, albArn, domain string, solver acmez.Solver) error {
+// UpdateAcmeCertificate obtains a new certificate for the domains and reimports it into the ACM certificate
+// of the first domain attached to the ALB, returning the ARN of that certificate.
+func UpdateAcmeCertificate(ctx context.Context, albArn string, domains []string, solver acmez.Solver) (string, error) {
+	if len(domains) == 0 {
+		return "", errors.New("no domains to update the certificate for")
+	}
+	domain := domains[0]
+
 	accountKey, err := getAccountKey()
 	if err != nil {
-		return fmt.Errorf("failed to get account key: %w", err)
+		return "", fmt.Errorf("failed to get account key: %w", err)
 	}
 
-	certToUpdate, _, err := GetExistingCertificate(ctx, albArn, domain)
+	certToUpdate, attached, err := FindCertificateToUpdate(ctx, albArn, domain, CreateMissingCertificate())
 	if err != nil {
-		return fmt.Errorf("failed to get existing certificate: %w", err)
+		return "", fmt.Errorf("failed to get existing certificate: %w", err)
 	}
 
-	acmeDirectory := os.Getenv("ACME_DIRECTORY")
-	if acmeDirectory == "" {
-		acmeDirectory = DefaultAcmeDirectory
+	acmeClient := Acme{
+		Directory:    DirectoryFromEnv(),
+		AccountKey:   accountKey,
+		Logger:       logger,
+		AlbArn:       albArn,
+		HttpSolver:   solver,
+		Resolvers:    DnsResolversFromEnv(),
+		SkipCAACheck: os.Getenv("ACME_SKIP_CAA_CHECK") == "true",
 	}
 
-	acmeClient := Acme{
-		Directory:  acmeDirectory,
-		AccountKey: accountKey,
-		Logger:     logger,
-		AlbArn:     albArn,
-		HttpSolver: solver,
+	key, chain, err := acmeClient.GetCertificate(ctx, domains)
+	if err != nil {
+		return "", fmt.Errorf("failed to get certificates: %w", err)
+	}
+
+	history := CertificateHistoryFromEnv()
+	certArn, err := DeployCertificate(ctx, history, albArn, domain, key, chain, certToUpdate, attached)
+	if err != nil {
+		return "", fmt.Errorf("error importing certificate: %w", err)
+	}
+
+	// Replication failures are reported per region but do not fail the update, the certificate is already
+	// in use in the primary region
+	if regions := ReplicaRegionsFromEnv(); len(regions) > 0 {
+		if _, err := ReplicateCertificate(ctx, history, regions, domain, key, chain); err != nil {
+			log.Printf("Certificate for %v was not replicated to all regions: %v", domain, err)
+		}
+	}
+	return certArn, nil
+}
+
+// CreateMissingCertificate reports whether ACME_CREATE_CERTIFICATE is set to create a new ACM certificate
+// when no certificate for the domain is attached to the ALB.
+func CreateMissingCertificate() bool {
+	return os.Getenv("ACME_CREATE_CERTIFICATE") == "true"
+}
+
+// FindCertificateToUpdate returns the ARN of the certificate for domain and whether it is attached to the ALB.
+// When create is set and no certificate is attached, a certificate previously created by cloudacme is looked
+// up by its tags, an empty ARN is returned when there is none so that a new certificate is created.
+func FindCertificateToUpdate(ctx context.Context, albArn, domain string, create bool) (string, bool, error) {
+	certArn, _, err := GetExistingCertificate(ctx, albArn, domain)
+	if err == nil {
+		return certArn, true, nil
+	}
+	if !create || !errors.Is(err, ErrCertificateNotFound) {
+		return "", false, err
+	}
+
+	log.Printf("No certificate for %v attached to ALB %v, looking for a certificate created by cloudacme", domain, albArn)
+	certArn, err = acm.FindImportedCertificateByTags(ctx, "", ManagedCertificateTags(domain, TargetAlb))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to find certificate by tags: %w", err)
 	}
+	return certArn, false, nil
+}
 
-	key, chain, err := acmeClient.GetCertificate(ctx, []string{domain})
+// DeployCertificate imports the certificate into certArn, or a new ACM certificate if certArn is empty,
+// and attaches it to the HTTPS listener of the ALB if it is not attached yet.
+func DeployCertificate(ctx context.Context, history CertificateHistory, albArn, domain string, key crypto.Signer, chain []byte, certArn string, attached bool) (string, error) {
+	if certArn == "" {
+		log.Printf("Importing %v as a new ACM certificate", domain)
+	}
+	certArn, err := ImportCertificate(ctx, history, "", key, chain, certArn, ManagedCertificateTags(domain, TargetAlb))
 	if err != nil {
-		return fmt.Errorf("failed to get certificates: %w", err)
+		return certArn, err
+	}
+
+	if !attached {
+		log.Printf("Attaching certificate %v to ALB %v", certArn, albArn)
+		if err := AttachCertificate(ctx, albArn, certArn); err != nil {
+			return certArn, fmt.Errorf("failed to attach certificate %v: %w", certArn, err)
+		}
 	}
+	return certArn, nil
+}
 
-	if err := acm.ImportCertificate(ctx, key, chain, certToUpdate); err != nil {
-		return fmt.Errorf("error importing certificate: %w", err)
+// AttachCertificate adds the certificate as an SNI certificate to every HTTPS listener of the ALB
+func AttachCertificate(ctx context.Context, albArn, certArn string) error {
+	listeners, err := alb.GetListeners(ctx, albArn, awsalb.ProtocolEnumHttps)
+	if err != nil {
+		return fmt.Errorf("cannot get https listeners: %w", err)
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("no https listener found on ALB %v", albArn)
+	}
+	for _, listener := range listeners {
+		if err := alb.AddListenerCertificate(ctx, *listener.ListenerArn, certArn); err != nil {
+			return fmt.Errorf("failed to attach to listener on port %d: %w", ptr.ToInt32(listener.Port), err)
+		}
 	}
 	return nil
 }
 
+// ManagedCertificateTags returns the tags of the certificate cloudacme manages for domain on target
+func ManagedCertificateTags(domain, target string) map[string]string {
+	return map[string]string{
+		TagManaged: "true",
+		TagDomain:  domain,
+		TagTarget:  target,
+	}
+}
+
 func GetExistingCertificate(ctx context.Context, albArn, domain string) (string, *x509.Certificate, error) {
 	// Find the certificate to update from all the certificates attached to the ALB
-	var certArns []string
+	var attachments []alb.ListenerCertificate
 	var err error
 	for i := 0; ; i++ {
-		certArns, err = alb.GetAlbCerts(ctx, albArn)
+		attachments, err = alb.GetAlbCerts(ctx, albArn)
 		if err != nil {
 			var apiErr smithy.APIError
 			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied" {
@@ -85,7 +193,18 @@ func GetExistingCertificate(ctx context.Context, albArn, domain string) (string,
 		break
 	}
 
+	// The same certificate can be attached to several listeners
+	var certArns []string
+	attachedTo := make(map[string][]alb.ListenerCertificate)
+	for _, lc := range attachments {
+		if _, ok := attachedTo[lc.CertificateArn]; !ok {
+			certArns = append(certArns, lc.CertificateArn)
+		}
+		attachedTo[lc.CertificateArn] = append(attachedTo[lc.CertificateArn], lc)
+	}
+
 	var getCertErrs []error
+	var candidates []certificateCandidate
 	for _, certArn := range certArns {
 		certPem, err := acm.GetCertificate(ctx, certArn)
 		if err != nil {
@@ -102,13 +221,120 @@ func GetExistingCertificate(ctx context.Context, albArn, domain string) (string,
 			getCertErrs = append(getCertErrs, fmt.Errorf("failed to parse certificate for %v: %w", certArn, err))
 			continue
 		}
-		if cert.Subject.CommonName == domain {
-			// TODO: check the issuer and expiration date
-			// TODO: should we check SANs? probably not, as byod domain are added as SNI single domain certs
-			return certArn, cert, nil
+		if !CertificateCovers(cert, domain) {
+			continue
+		}
+		// Without its tags the certificate is still a candidate, taken as not managed, rather than being left
+		// out and a duplicate created for the domain
+		tags, err := acm.ListTags(ctx, certArn)
+		if err != nil {
+			log.Printf("Failed to get tags for %v, taking it as not managed by cloudacme: %v", certArn, err)
+		}
+		candidates = append(candidates, certificateCandidate{arn: certArn, cert: cert, managed: tags[TagManaged] == "true"})
+	}
+
+	if len(candidates) > 0 {
+		best := selectCertificate(candidates)
+		log.Printf("Selected certificate %v for %v, attached to %v", best.arn, domain, describeAttachments(attachedTo[best.arn]))
+		return best.arn, best.cert, nil
+	}
+	// A certificate that could not be read might cover the domain, it is not taken as missing so that no
+	// duplicate is created
+	if len(getCertErrs) > 0 {
+		return "", nil, fmt.Errorf("failed to read the certificates attached to ALB %v for %v: %w", albArn, domain, errors.Join(getCertErrs...))
+	}
+	return "", nil, fmt.Errorf("%w for %v", ErrCertificateNotFound, domain)
+}
+
+// describeAttachments lists the listener ports a certificate is attached to, reimporting the certificate
+// updates it on all of them
+func describeAttachments(lcs []alb.ListenerCertificate) string {
+	var parts []string
+	for _, lc := range lcs {
+		kind := "SNI"
+		if lc.IsDefault {
+			kind = "default"
+		}
+		parts = append(parts, fmt.Sprintf("port %d (%s)", lc.Port, kind))
+	}
+	return strings.Join(parts, ", ")
+}
+
+type certificateCandidate struct {
+	arn     string
+	cert    *x509.Certificate
+	managed bool
+}
+
+// selectCertificate picks the certificate managed by cloudacme, then the one expiring last, and logs why
+func selectCertificate(candidates []certificateCandidate) certificateCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].managed != candidates[j].managed {
+			return candidates[i].managed
+		}
+		return candidates[i].cert.NotAfter.After(candidates[j].cert.NotAfter)
+	})
+	if len(candidates) > 1 {
+		for i, c := range candidates {
+			log.Printf("Candidate %d: %v managed=%v expires=%v names=%v", i+1, c.arn, c.managed, c.cert.NotAfter, c.cert.DNSNames)
+		}
+		reason := "it expires last"
+		if candidates[0].managed && !candidates[1].managed {
+			reason = "it is managed by cloudacme"
+		} else if candidates[0].managed {
+			reason = "it is managed by cloudacme and expires last"
+		}
+		log.Printf("%d certificates match, selected %v as %v", len(candidates), candidates[0].arn, reason)
+	}
+	return candidates[0]
+}
+
+// CertificateCovers reports whether the DNS SANs of the certificate, or its common name when it has no SANs,
+// cover domain. A wildcard name covers exactly one left-most label, and a wildcard domain is only covered by
+// the same wildcard.
+func CertificateCovers(cert *x509.Certificate, domain string) bool {
+	names := cert.DNSNames
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = []string{cert.Subject.CommonName}
+	}
+	for _, name := range names {
+		if MatchHostname(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateDomains returns domain followed by the other names of the certificate, so that a renewal keeps all
+// the SANs. Wildcard names are left out, as HTTP-01 cannot validate them.
+func CertificateDomains(domain string, cert *x509.Certificate) []string {
+	domains := []string{domain}
+	if cert == nil {
+		return domains
+	}
+	for _, name := range cert.DNSNames {
+		if strings.HasPrefix(name, "*.") {
+			log.Printf("Wildcard name %v of the certificate for %v cannot be renewed with HTTP-01, leaving it out", name, domain)
+			continue
+		}
+		if !slices.ContainsFunc(domains, func(d string) bool { return strings.EqualFold(d, name) }) {
+			domains = append(domains, name)
 		}
 	}
-	return "", nil, fmt.Errorf("no certificate matching %v found: %w", domain, errors.Join(getCertErrs...))
+	return domains
+}
+
+func MatchHostname(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern == host {
+		return true
+	}
+	if !strings.HasPrefix(pattern, "*.") || strings.HasPrefix(host, "*.") {
+		return false
+	}
+	_, parent, found := strings.Cut(host, ".")
+	return found && parent == pattern[2:]
 }
 
 func MoveHttpRulePath(ctx context.Context, albArn string, oldCond alb.RuleCondition, newPathPattern []string) error {
@@ -128,12 +354,19 @@ func SetupHttpRule(ctx context.Context, albArn, lambdaArn string, ruleCond alb.R
 		return fmt.Errorf("cannot get http listener: %w", err)
 	}
 
+	if _, err := alb.FindRule(ctx, *listener.ListenerArn, ruleCond); err == nil {
+		log.Printf("HTTP rule for %v %v already exists", ruleCond.HostHeader, ruleCond.PathPattern)
+		return nil
+	} else if !errors.Is(err, alb.ErrRuleNotFound) {
+		return fmt.Errorf("cannot get listener rules: %w", err)
+	}
+
 	targetGroupArn, err := alb.GetLambdaTargetGroup(ctx, lambdaArn)
 	if err != nil {
 		return fmt.Errorf("cannot get target group for lambda %v: %w", lambdaArn, err)
 	}
 
-	if err := alb.AddListenerTriggerTargetGroupRule(ctx, *listener.ListenerArn, ruleCond, targetGroupArn); err != nil {
+	if err := alb.AddListenerTriggerTargetGroupRule(ctx, *listener.ListenerArn, ruleCond, targetGroupArn, alb.RuleTypeTrigger); err != nil {
 		return fmt.Errorf("failed to create listener static rule: %w", err)
 	}
 	return nil
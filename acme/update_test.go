@@ -0,0 +1,305 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMatchHostname(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com.", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "WWW.Example.com", true},
+		{"*.example.com", "www.example.com.", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", "wwwexample.com", false},
+		{"*.example.com", "www.example.org", false},
+		{"*.example.com", "*.example.com", true},
+		{"*.example.com", "*.www.example.com", false},
+		{"www.example.com", "*.example.com", false},
+		{"*.b.example.com", "a.b.example.com", true},
+		{"www.*.com", "www.example.com", false},
+		{"*", "example", false},
+	}
+	for _, tt := range tests {
+		if got := MatchHostname(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("MatchHostname(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCertificateCovers(t *testing.T) {
+	sans := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "legacy.example.org"},
+		DNSNames: []string{"example.com", "*.example.com", "api.eu.example.com"},
+	}
+	cnOnly := &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}}
+	wildcardCN := &x509.Certificate{Subject: pkix.Name{CommonName: "*.example.com"}}
+	noNames := &x509.Certificate{}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		domain string
+		want   bool
+	}{
+		{"apex SAN", sans, "example.com", true},
+		{"wildcard SAN", sans, "www.example.com", true},
+		{"multi-label SAN", sans, "api.eu.example.com", true},
+		{"multi-label not covered by wildcard", sans, "web.eu.example.com", false},
+		{"wildcard domain", sans, "*.example.com", true},
+		{"common name ignored with SANs", sans, "legacy.example.org", false},
+		{"other domain", sans, "example.org", false},
+		{"common name without SANs", cnOnly, "www.example.com", true},
+		{"common name other domain", cnOnly, "api.example.com", false},
+		{"wildcard common name", wildcardCN, "api.example.com", true},
+		{"missing common name", noNames, "example.com", false},
+		{"empty domain", noNames, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CertificateCovers(tt.cert, tt.domain); got != tt.want {
+				t.Errorf("CertificateCovers(%v, %q) = %v, want %v", tt.cert.DNSNames, tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectCertificate(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	candidate := func(arn string, managed bool, expiresIn time.Duration) certificateCandidate {
+		return certificateCandidate{arn: arn, managed: managed, cert: &x509.Certificate{NotAfter: now.Add(expiresIn)}}
+	}
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		candidates []certificateCandidate
+		want       string
+	}{
+		{"single", []certificateCandidate{candidate("a", false, 10*day)}, "a"},
+		{"expires last", []certificateCandidate{candidate("a", false, 10*day), candidate("b", false, 60*day), candidate("c", false, 30*day)}, "b"},
+		{"managed before expiry", []certificateCandidate{candidate("a", false, 80*day), candidate("b", true, 10*day)}, "b"},
+		{"managed expiring last", []certificateCandidate{candidate("a", true, 10*day), candidate("b", false, 90*day), candidate("c", true, 40*day)}, "c"},
+		{"same expiry keeps order", []certificateCandidate{candidate("a", false, 10*day), candidate("b", false, 10*day)}, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectCertificate(tt.candidates); got.arn != tt.want {
+				t.Errorf("selectCertificate() = %v, want %v", got.arn, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAWS is a stand-in of the ELBv2 listener and ACM certificate APIs used to find the certificate to update
+type fakeAWS struct {
+	mu        sync.Mutex
+	listeners map[string][]fakeListener // by load balancer ARN
+	certs     map[string]string         // PEM by certificate ARN
+	tags      map[string]map[string]string
+	fail      map[string]string // error code answered to an ACM operation on a certificate, by "Operation ARN"
+}
+
+type fakeListener struct {
+	arn   string
+	port  int
+	certs []string // the first one is the default certificate
+}
+
+var (
+	fakeAWSOnce    sync.Once
+	fakeAWSCurrent atomic.Pointer[fakeAWS]
+)
+
+// newFakeAWS points the AWS clients at a stand-in, one server is shared by the tests as the AWS configuration
+// is only loaded once
+func newFakeAWS(t *testing.T) *fakeAWS {
+	t.Helper()
+	fakeAWSOnce.Do(func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fakeAWSCurrent.Load().ServeHTTP(w, r)
+		}))
+		os.Setenv("AWS_ENDPOINT_URL", srv.URL)
+		os.Setenv("AWS_REGION", "us-east-1")
+		os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	})
+	api := &fakeAWS{listeners: map[string][]fakeListener{}, certs: map[string]string{}, tags: map[string]map[string]string{}, fail: map[string]string{}}
+	fakeAWSCurrent.Store(api)
+	return api
+}
+
+// addCert adds a certificate for the names expiring in the given number of days, returning its ARN
+func (api *fakeAWS) addCert(t *testing.T, id string, days int, tags map[string]string, names ...string) string {
+	t.Helper()
+	arn := "arn:aws:acm:us-east-1:123456789012:certificate/" + id
+	cert, _ := issueCertificate(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+		NotAfter: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+	}, nil, nil)
+	api.certs[arn] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	api.tags[arn] = tags
+	return arn
+}
+
+func (api *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		var req struct{ CertificateArn string }
+		json.NewDecoder(r.Body).Decode(&req)
+		op := strings.TrimPrefix(target, "CertificateManager.")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if code, ok := api.fail[op+" "+req.CertificateArn]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":%q,"message":"%v failed"}`, code, op)
+			return
+		}
+		switch op {
+		case "GetCertificate":
+			json.NewEncoder(w).Encode(map[string]string{"Certificate": api.certs[req.CertificateArn]})
+		case "ListTagsForCertificate":
+			tags := []map[string]string{}
+			for k, v := range api.tags[req.CertificateArn] {
+				tags = append(tags, map[string]string{"Key": k, "Value": v})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Tags": tags})
+		case "ListCertificates":
+			summaries := []map[string]string{}
+			for arn := range api.certs {
+				summaries = append(summaries, map[string]string{"CertificateArn": arn, "Type": "IMPORTED"})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"CertificateSummaryList": summaries})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnknownOperationException","message":%q}`, op)
+		}
+		return
+	}
+
+	r.ParseForm()
+	action := r.Form.Get("Action")
+	var result strings.Builder
+	switch action {
+	case "DescribeListeners":
+		result.WriteString("<Listeners>")
+		for _, l := range api.listeners[r.Form.Get("LoadBalancerArn")] {
+			fmt.Fprintf(&result, "<member><ListenerArn>%v</ListenerArn><Port>%d</Port><Protocol>HTTPS</Protocol></member>", l.arn, l.port)
+		}
+		result.WriteString("</Listeners>")
+	case "DescribeListenerCertificates":
+		result.WriteString("<Certificates>")
+		for _, ls := range api.listeners {
+			for _, l := range ls {
+				if l.arn != r.Form.Get("ListenerArn") {
+					continue
+				}
+				for i, arn := range l.certs {
+					fmt.Fprintf(&result, "<member><CertificateArn>%v</CertificateArn><IsDefault>%v</IsDefault></member>", arn, i == 0)
+				}
+			}
+		}
+		result.WriteString("</Certificates>")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>InvalidAction</Code><Message>%v</Message></Error></ErrorResponse>", action)
+		return
+	}
+	fmt.Fprintf(w, "<%[1]vResponse><%[1]vResult>%[2]v</%[1]vResult><ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></%[1]vResponse>", action, result.String())
+}
+
+// errCertificateNotRead is the error wanted when an attached certificate cannot be read
+var errCertificateNotRead = errors.New("certificate not read")
+
+func TestGetExistingCertificate(t *testing.T) {
+	const albArn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/test/1"
+	ctx := context.Background()
+	managed := map[string]string{TagManaged: "true"}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, api *fakeAWS) []string // returns the certificates attached to the listener
+		domain  string
+		want    string
+		wantErr error
+	}{
+		{"covering certificate", func(t *testing.T, api *fakeAWS) []string {
+			return []string{api.addCert(t, "a", 30, nil, "example.com", "www.example.com"), api.addCert(t, "b", 60, nil, "example.org")}
+		}, "www.example.com", "a", nil},
+		{"managed before expiring last", func(t *testing.T, api *fakeAWS) []string {
+			return []string{api.addCert(t, "a", 80, nil, "www.example.com"), api.addCert(t, "b", 10, managed, "*.example.com")}
+		}, "www.example.com", "b", nil},
+		{"tags not readable", func(t *testing.T, api *fakeAWS) []string {
+			arn := api.addCert(t, "a", 30, managed, "www.example.com")
+			api.fail["ListTagsForCertificate "+arn] = "AccessDeniedException"
+			return []string{arn}
+		}, "www.example.com", "a", nil},
+		{"tags not readable taken as not managed", func(t *testing.T, api *fakeAWS) []string {
+			arn := api.addCert(t, "a", 30, managed, "www.example.com")
+			api.fail["ListTagsForCertificate "+arn] = "AccessDeniedException"
+			return []string{arn, api.addCert(t, "b", 60, nil, "www.example.com")}
+		}, "www.example.com", "b", nil},
+		{"no covering certificate", func(t *testing.T, api *fakeAWS) []string {
+			return []string{api.addCert(t, "a", 30, managed, "example.com")}
+		}, "www.example.com", "", ErrCertificateNotFound},
+		{"certificate not readable", func(t *testing.T, api *fakeAWS) []string {
+			arn := api.addCert(t, "a", 30, managed, "www.example.com")
+			api.fail["GetCertificate "+arn] = "AccessDeniedException"
+			return []string{arn}
+		}, "www.example.com", "", errCertificateNotRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeAWS(t)
+			certs := tt.setup(t, api)
+			api.listeners[albArn] = []fakeListener{{arn: albArn + "/listener/443", port: 443, certs: certs}}
+
+			certArn, cert, err := GetExistingCertificate(ctx, albArn, tt.domain)
+			if tt.wantErr != nil {
+				if tt.wantErr == errCertificateNotRead {
+					if err == nil || errors.Is(err, ErrCertificateNotFound) {
+						t.Fatalf("GetExistingCertificate() error = %v, want an error other than %v", err, ErrCertificateNotFound)
+					}
+					if _, attached, err := FindCertificateToUpdate(ctx, albArn, tt.domain, true); err == nil || attached {
+						t.Errorf("FindCertificateToUpdate() error = %v, want the certificate not to be created", err)
+					}
+					return
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GetExistingCertificate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetExistingCertificate() error = %v", err)
+			}
+			if want := "arn:aws:acm:us-east-1:123456789012:certificate/" + tt.want; certArn != want || cert == nil {
+				t.Errorf("GetExistingCertificate() = %v, want %v", certArn, want)
+			}
+		})
+	}
+}
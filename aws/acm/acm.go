@@ -6,17 +6,25 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"strings"
 
 	"github.com/DefangLabs/cloudacme/aws"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
 )
 
-func ImportCertificate(ctx context.Context, privateKey crypto.PrivateKey, certChainPem []byte, certArn string) error {
-	svc := acm.NewFromConfig(aws.LoadConfig())
+// ImportCertificate imports the certificate chain as a new certificate in region, or the default region when
+// empty, when certArn is empty, or reimports it into certArn, and returns the ARN of the certificate.
+// Tags can only be set on a new certificate.
+func ImportCertificate(ctx context.Context, region string, privateKey crypto.PrivateKey, certChainPem []byte, certArn string, tags map[string]string) (string, error) {
+	if certArn != "" {
+		region = regionOf(certArn)
+	}
+	svc := newClient(region)
 
 	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	certsPem := bytes.Split(certChainPem, []byte("\n\n"))
@@ -34,16 +42,75 @@ func ImportCertificate(ctx context.Context, privateKey crypto.PrivateKey, certCh
 		CertificateChain: certChainPem,
 		CertificateArn:   arn,
 	}
+	if len(certsPem) == 1 {
+		// Self signed certificates have no chain
+		input.CertificateChain = nil
+	}
+	if arn == nil {
+		for k, v := range tags {
+			input.Tags = append(input.Tags, types.Tag{Key: &k, Value: &v})
+		}
+	}
+
+	output, err := svc.ImportCertificate(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	return *output.CertificateArn, nil
+}
+
+// FindImportedCertificateByTags returns the ARN of the first imported certificate in region that has all
+// the given tags, or an empty string if there is none.
+func FindImportedCertificateByTags(ctx context.Context, region string, tags map[string]string) (string, error) {
+	svc := newClient(region)
+
+	// Only RSA_1024 and RSA_2048 certificates are listed unless key types are specified
+	paginator := acm.NewListCertificatesPaginator(svc, &acm.ListCertificatesInput{
+		Includes: &types.Filters{KeyTypes: types.KeyAlgorithm("").Values()},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, summary := range page.CertificateSummaryList {
+			if summary.Type != types.CertificateTypeImported {
+				continue
+			}
+			certTags, err := ListTags(ctx, *summary.CertificateArn)
+			if err != nil {
+				return "", err
+			}
+			if hasTags(certTags, tags) {
+				return *summary.CertificateArn, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func ListTags(ctx context.Context, certArn string) (map[string]string, error) {
+	svc := newClient(regionOf(certArn))
 
-	if _, err := svc.ImportCertificate(ctx, input); err != nil {
-		return err
+	output, err := svc.ListTagsForCertificate(ctx, &acm.ListTagsForCertificateInput{
+		CertificateArn: &certArn,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	tags := make(map[string]string, len(output.Tags))
+	for _, tag := range output.Tags {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags, nil
 }
 
 func GetCertificate(ctx context.Context, certArn string) ([]byte, error) {
-	svc := acm.NewFromConfig(aws.LoadConfig())
+	svc := newClient(regionOf(certArn))
 
 	input := &acm.GetCertificateInput{
 		CertificateArn: &certArn,
@@ -56,3 +123,81 @@ func GetCertificate(ctx context.Context, certArn string) ([]byte, error) {
 
 	return []byte(*output.Certificate), nil
 }
+
+func hasTags(tags, want map[string]string) bool {
+	for k, v := range want {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// newClient returns a client for region, or the default region when empty
+func newClient(region string) *acm.Client {
+	return acm.NewFromConfig(aws.LoadConfig(), func(o *acm.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	})
+}
+
+// regionOf returns the region of an ARN in the form arn:partition:service:region:account:resource
+func regionOf(arn string) string {
+	parts := strings.SplitN(arn, ":", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[3]
+}
+
+// IsImported reports whether the certificate was imported, only imported certificates can be reimported
+func IsImported(ctx context.Context, certArn string) (bool, error) {
+	svc := newClient(regionOf(certArn))
+
+	output, err := svc.DescribeCertificate(ctx, &acm.DescribeCertificateInput{
+		CertificateArn: &certArn,
+	})
+	if err != nil {
+		return false, err
+	}
+	return output.Certificate.Type == types.CertificateTypeImported, nil
+}
+
+// GetCertificateChain returns the intermediate certificates imported with the certificate
+func GetCertificateChain(ctx context.Context, certArn string) ([]byte, error) {
+	svc := newClient(regionOf(certArn))
+
+	output, err := svc.GetCertificate(ctx, &acm.GetCertificateInput{
+		CertificateArn: &certArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.CertificateChain == nil {
+		return nil, nil
+	}
+	return []byte(*output.CertificateChain), nil
+}
+
+func AddTags(ctx context.Context, certArn string, tags map[string]string) error {
+	svc := newClient(regionOf(certArn))
+
+	input := &acm.AddTagsToCertificateInput{CertificateArn: &certArn}
+	for k, v := range tags {
+		input.Tags = append(input.Tags, types.Tag{Key: &k, Value: &v})
+	}
+	_, err := svc.AddTagsToCertificate(ctx, input)
+	return err
+}
+
+func RemoveTags(ctx context.Context, certArn string, keys ...string) error {
+	svc := newClient(regionOf(certArn))
+
+	input := &acm.RemoveTagsFromCertificateInput{CertificateArn: &certArn}
+	for _, k := range keys {
+		input.Tags = append(input.Tags, types.Tag{Key: &k})
+	}
+	_, err := svc.RemoveTagsFromCertificate(ctx, input)
+	return err
+}
@@ -0,0 +1,216 @@
+package alb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+const (
+	MinRulePriority = 1
+	MaxRulePriority = 50000
+)
+
+// PriorityBand is a range of listener rule priorities reserved for the rules cloudacme creates
+type PriorityBand struct {
+	Min int32
+	Max int32
+}
+
+// ParsePriorityBand parses a band such as "100-199", an empty string is the full range of priorities
+func ParsePriorityBand(s string) (PriorityBand, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return PriorityBand{Min: MinRulePriority, Max: MaxRulePriority}, nil
+	}
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return PriorityBand{}, fmt.Errorf("invalid priority band %q, expected a range such as 100-199", s)
+	}
+	first, err := strconv.ParseInt(strings.TrimSpace(lo), 10, 32)
+	if err != nil {
+		return PriorityBand{}, fmt.Errorf("invalid priority band %q: %w", s, err)
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(hi), 10, 32)
+	if err != nil {
+		return PriorityBand{}, fmt.Errorf("invalid priority band %q: %w", s, err)
+	}
+	if first < MinRulePriority || last > MaxRulePriority || first > last {
+		return PriorityBand{}, fmt.Errorf("priority band %q must be within %d-%d", s, MinRulePriority, MaxRulePriority)
+	}
+	return PriorityBand{Min: int32(first), Max: int32(last)}, nil
+}
+
+func (b PriorityBand) String() string {
+	return fmt.Sprintf("%d-%d", b.Min, b.Max)
+}
+
+type priorityBandKey struct{}
+
+// WithPriorityBand returns a context whose rules are created with a priority within band
+func WithPriorityBand(ctx context.Context, band PriorityBand) context.Context {
+	return context.WithValue(ctx, priorityBandKey{}, band)
+}
+
+func priorityBandFromContext(ctx context.Context) PriorityBand {
+	if band, ok := ctx.Value(priorityBandKey{}).(PriorityBand); ok {
+		return band
+	}
+	return PriorityBand{Min: MinRulePriority, Max: MaxRulePriority}
+}
+
+// GetSafePriority returns a free priority for a new rule with the conditions ruleCond, ahead of every rule of
+// the listener that could match the same requests, as the rule with the lowest priority wins. When no such
+// priority is free a warning is logged and the first free priority is returned, the new rule may be shadowed.
+func GetSafePriority(ctx context.Context, listenerArn string, ruleCond RuleCondition) (int32, error) {
+	rules, err := GetAllRules(ctx, listenerArn)
+	if err != nil {
+		return 0, err
+	}
+	band := priorityBandFromContext(ctx)
+	priority, shadow, err := SafePriority(rules, ruleCond, band)
+	if err != nil {
+		return 0, fmt.Errorf("listener %v: %w", listenerArn, err)
+	}
+	if shadow != nil {
+		log.Printf("WARNING: no free priority in %v ahead of rule %v with priority %v (%v), the rule for %v %v at priority %d may never match",
+			band, ptr.ToString(shadow.RuleArn), ptr.ToString(shadow.Priority), DescribeConditions(*shadow), ruleCond.HostHeader, ruleCond.PathPattern, priority)
+	}
+	return priority, nil
+}
+
+// SafePriority picks the lowest free priority in band ahead of the first of rules that overlaps ruleCond.
+// When there is none, it returns the lowest free priority in band along with the overlapping rule.
+func SafePriority(rules []types.Rule, ruleCond RuleCondition, band PriorityBand) (int32, *types.Rule, error) {
+	used := make(map[int32]bool, len(rules))
+	var shadow *types.Rule
+	shadowPriority := int32(MaxRulePriority + 1)
+	for i, rule := range rules {
+		if ptr.ToBool(rule.IsDefault) {
+			continue // the default rule is evaluated last
+		}
+		p, err := strconv.Atoi(ptr.ToString(rule.Priority))
+		if err != nil {
+			continue
+		}
+		used[int32(p)] = true
+		if int32(p) < shadowPriority && RulesOverlap(rule, ruleCond) {
+			shadow, shadowPriority = &rules[i], int32(p)
+		}
+	}
+
+	firstFree := func(last int32) (int32, bool) {
+		for p := band.Min; p <= last; p++ {
+			if !used[p] {
+				return p, true
+			}
+		}
+		return 0, false
+	}
+
+	if p, ok := firstFree(min(band.Max, shadowPriority-1)); ok {
+		return p, nil, nil
+	}
+	if p, ok := firstFree(band.Max); ok {
+		return p, shadow, nil
+	}
+	return 0, nil, fmt.Errorf("no free rule priority in %v", band)
+}
+
+// RulesOverlap reports whether some request matching ruleCond could also match the rule. Conditions other
+// than host and path are assumed to match, except request methods that a GET would not match.
+func RulesOverlap(rule types.Rule, ruleCond RuleCondition) bool {
+	for _, cond := range rule.Conditions {
+		switch {
+		case cond.HostHeaderConfig != nil:
+			if len(ruleCond.HostHeader) > 0 && !anyPatternsIntersect(cond.HostHeaderConfig.Values, ruleCond.HostHeader, true) {
+				return false
+			}
+		case cond.PathPatternConfig != nil:
+			if len(ruleCond.PathPattern) > 0 && !anyPatternsIntersect(cond.PathPatternConfig.Values, ruleCond.PathPattern, false) {
+				return false
+			}
+		case cond.HttpRequestMethodConfig != nil:
+			// challenge and trigger requests are GETs
+			if !slices.Contains(cond.HttpRequestMethodConfig.Values, "GET") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func anyPatternsIntersect(a, b []string, fold bool) bool {
+	for _, pa := range a {
+		for _, pb := range b {
+			if patternsIntersect(pa, pb, fold) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// patternsIntersect reports whether some string matches both ALB condition patterns, where * matches any
+// number of characters and ? matches exactly one. Host patterns are compared case insensitively.
+func patternsIntersect(a, b string, fold bool) bool {
+	if fold {
+		a, b = strings.ToLower(a), strings.ToLower(b)
+	}
+	ra, rb := []rune(a), []rune(b)
+	// memo[i][j] is 0 when unknown, 1 when the suffixes ra[i:] and rb[j:] intersect, 2 when they do not
+	memo := make([][]byte, len(ra)+1)
+	for i := range memo {
+		memo[i] = make([]byte, len(rb)+1)
+	}
+
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		if memo[i][j] != 0 {
+			return memo[i][j] == 1
+		}
+		var ok bool
+		switch {
+		case i < len(ra) && ra[i] == '*':
+			// the star matches nothing, or also the next character of the other pattern
+			ok = match(i+1, j) || (j < len(rb) && match(i, j+1))
+		case j < len(rb) && rb[j] == '*':
+			ok = match(i, j+1) || (i < len(ra) && match(i+1, j))
+		case i == len(ra) || j == len(rb):
+			ok = i == len(ra) && j == len(rb)
+		default:
+			ok = (ra[i] == '?' || rb[j] == '?' || ra[i] == rb[j]) && match(i+1, j+1)
+		}
+		memo[i][j] = 2
+		if ok {
+			memo[i][j] = 1
+		}
+		return ok
+	}
+	return match(0, 0)
+}
+
+// DescribeConditions returns the conditions of the rule for logging
+func DescribeConditions(rule types.Rule) string {
+	var conds []string
+	for _, cond := range rule.Conditions {
+		switch {
+		case cond.HostHeaderConfig != nil:
+			conds = append(conds, "host "+strings.Join(cond.HostHeaderConfig.Values, ","))
+		case cond.PathPatternConfig != nil:
+			conds = append(conds, "path "+strings.Join(cond.PathPatternConfig.Values, ","))
+		case cond.Field != nil:
+			conds = append(conds, *cond.Field)
+		}
+	}
+	if len(conds) == 0 {
+		return "any request"
+	}
+	return strings.Join(conds, " ")
+}
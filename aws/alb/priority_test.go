@@ -0,0 +1,222 @@
+package alb
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+func hostCond(values ...string) types.RuleCondition {
+	return types.RuleCondition{Field: ptr.String("host-header"), HostHeaderConfig: &types.HostHeaderConditionConfig{Values: values}}
+}
+
+func pathCond(values ...string) types.RuleCondition {
+	return types.RuleCondition{Field: ptr.String("path-pattern"), PathPatternConfig: &types.PathPatternConditionConfig{Values: values}}
+}
+
+func methodCond(values ...string) types.RuleCondition {
+	return types.RuleCondition{Field: ptr.String("http-request-method"), HttpRequestMethodConfig: &types.HttpRequestMethodConditionConfig{Values: values}}
+}
+
+func rule(priority string, conds ...types.RuleCondition) types.Rule {
+	return types.Rule{RuleArn: ptr.String("rule-" + priority), Priority: ptr.String(priority), Conditions: conds}
+}
+
+func TestPatternsIntersect(t *testing.T) {
+	tests := []struct {
+		a, b string
+		fold bool
+		want bool
+	}{
+		{"/foo", "/foo", false, true},
+		{"/foo", "/bar", false, false},
+		{"/foo", "/FOO", false, false},
+		{"www.example.com", "WWW.Example.com", true, true},
+		{"*", "/.well-known/acme-challenge/abc", false, true},
+		{"/.well-known/*", "/.well-known/acme-challenge/abc", false, true},
+		{"/api/*", "/.well-known/acme-challenge/abc", false, false},
+		{"/*.txt", "/.well-known/acme-challenge/*", false, true},
+		{"/*.txt", "/.well-known/acme-challenge/abc", false, false},
+		{"/a?c", "/abc", false, true},
+		{"/a?c", "/abbc", false, false},
+		{"/a*", "*b", false, true},
+		{"a*b", "c*", false, false},
+		{"*.example.com", "www.example.com", true, true},
+		{"*.example.com", "example.com", true, false},
+		{"*.example.com", "*.example.org", true, false},
+		{"", "", false, true},
+		{"", "*", false, true},
+		{"", "?", false, false},
+	}
+	for _, tt := range tests {
+		if got := patternsIntersect(tt.a, tt.b, tt.fold); got != tt.want {
+			t.Errorf("patternsIntersect(%q, %q, %v) = %v, want %v", tt.a, tt.b, tt.fold, got, tt.want)
+		}
+		if got := patternsIntersect(tt.b, tt.a, tt.fold); got != tt.want {
+			t.Errorf("patternsIntersect(%q, %q, %v) = %v, want %v", tt.b, tt.a, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestRulesOverlap(t *testing.T) {
+	challenge := RuleCondition{
+		HostHeader:  []string{"www.example.com"},
+		PathPattern: []string{"/.well-known/acme-challenge/abc"},
+	}
+	tests := []struct {
+		name string
+		rule types.Rule
+		want bool
+	}{
+		{"no conditions", rule("1"), true},
+		{"same host", rule("1", hostCond("www.example.com")), true},
+		{"wildcard host", rule("1", hostCond("*.example.com")), true},
+		{"other host", rule("1", hostCond("api.example.com")), false},
+		{"any of the hosts", rule("1", hostCond("api.example.com", "WWW.example.com")), true},
+		{"catch all path", rule("1", pathCond("/*")), true},
+		{"other path", rule("1", pathCond("/api/*")), false},
+		{"same host other path", rule("1", hostCond("www.example.com"), pathCond("/api/*")), false},
+		{"same host and path", rule("1", hostCond("www.example.com"), pathCond("/.well-known/*")), true},
+		{"GET method", rule("1", methodCond("GET", "HEAD")), true},
+		{"POST method", rule("1", methodCond("POST")), false},
+		{"source ip assumed to match", rule("1", types.RuleCondition{Field: ptr.String("source-ip"), SourceIpConfig: &types.SourceIpConditionConfig{Values: []string{"10.0.0.0/8"}}}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RulesOverlap(tt.rule, challenge); got != tt.want {
+				t.Errorf("RulesOverlap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("host only condition", func(t *testing.T) {
+		if !RulesOverlap(rule("1", pathCond("/api/*")), RuleCondition{HostHeader: []string{"www.example.com"}}) {
+			t.Error("a rule on any path overlaps a condition without path")
+		}
+	})
+}
+
+func TestSafePriority(t *testing.T) {
+	challenge := RuleCondition{
+		HostHeader:  []string{"www.example.com"},
+		PathPattern: []string{"/.well-known/acme-challenge/abc"},
+	}
+	full := PriorityBand{Min: MinRulePriority, Max: MaxRulePriority}
+	defaultRule := types.Rule{RuleArn: ptr.String("default"), Priority: ptr.String("default"), IsDefault: ptr.Bool(true)}
+
+	tests := []struct {
+		name       string
+		rules      []types.Rule
+		band       PriorityBand
+		want       int32
+		wantShadow string
+		wantErr    bool
+	}{
+		{
+			name:  "empty listener",
+			rules: []types.Rule{defaultRule},
+			band:  full,
+			want:  1,
+		},
+		{
+			name:  "first free priority",
+			rules: []types.Rule{rule("1", hostCond("api.example.com")), rule("2", hostCond("api.example.com")), rule("4", hostCond("api.example.com")), defaultRule},
+			band:  full,
+			want:  3,
+		},
+		{
+			name:  "ahead of an overlapping rule",
+			rules: []types.Rule{rule("1", hostCond("api.example.com")), rule("4", hostCond("api.example.com")), rule("3", pathCond("/*"))},
+			band:  full,
+			want:  2,
+		},
+		{
+			name:  "free priority before the overlapping rule",
+			rules: []types.Rule{rule("2", hostCond("api.example.com")), rule("5", hostCond("*.example.com"))},
+			band:  full,
+			want:  1,
+		},
+		{
+			name:       "no free priority ahead of the overlapping rule",
+			rules:      []types.Rule{rule("1", hostCond("api.example.com")), rule("2", hostCond("*.example.com"))},
+			band:       full,
+			want:       3,
+			wantShadow: "rule-2",
+		},
+		{
+			name:       "lowest overlapping rule is reported",
+			rules:      []types.Rule{rule("1", pathCond("/*")), rule("3", hostCond("www.example.com"))},
+			band:       full,
+			want:       2,
+			wantShadow: "rule-1",
+		},
+		{
+			name:  "within band",
+			rules: []types.Rule{rule("100", hostCond("api.example.com")), rule("300", hostCond("www.example.com"))},
+			band:  PriorityBand{Min: 100, Max: 199},
+			want:  101,
+		},
+		{
+			name:       "band after the overlapping rule",
+			rules:      []types.Rule{rule("50", hostCond("www.example.com"))},
+			band:       PriorityBand{Min: 100, Max: 199},
+			want:       100,
+			wantShadow: "rule-50",
+		},
+		{
+			name:    "band full",
+			rules:   []types.Rule{rule("10", hostCond("api.example.com")), rule("11", hostCond("api.example.com"))},
+			band:    PriorityBand{Min: 10, Max: 11},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, shadow, err := SafePriority(tt.rules, challenge, tt.band)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("SafePriority() = %d, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SafePriority() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SafePriority() = %d, want %d", got, tt.want)
+			}
+			if shadowArn := ptr.ToString(ruleArn(shadow)); shadowArn != tt.wantShadow {
+				t.Errorf("SafePriority() shadow = %q, want %q", shadowArn, tt.wantShadow)
+			}
+		})
+	}
+}
+
+func TestRuleConditionMatches(t *testing.T) {
+	target := RuleCondition{HostHeader: []string{"www.example.com"}, PathPattern: []string{"/.well-known/acme-challenge/abc"}}
+	tests := []struct {
+		name string
+		rule types.Rule
+		want bool
+	}{
+		{"same conditions", rule("1", pathCond("/.well-known/acme-challenge/abc"), hostCond("www.example.com")), true},
+		{"other path", rule("1", pathCond("/.well-known/acme-challenge/def"), hostCond("www.example.com")), false},
+		{"missing host", rule("1", pathCond("/.well-known/acme-challenge/abc")), false},
+		{"additional method", rule("1", pathCond("/.well-known/acme-challenge/abc"), hostCond("www.example.com"), methodCond("GET")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RuleConditionMatches(tt.rule, target); got != tt.want {
+				t.Errorf("RuleConditionMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ruleArn(rule *types.Rule) *string {
+	if rule == nil {
+		return nil
+	}
+	return rule.RuleArn
+}
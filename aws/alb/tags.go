@@ -0,0 +1,77 @@
+package alb
+
+import (
+	"context"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+// Tags of the listener rules created by cloudacme, so that rules left behind by an interrupted run can be
+// found and deleted
+const (
+	TagOwner    = "cloudacme:owner"
+	TagCreated  = "cloudacme:created" // RFC 3339
+	TagOrderId  = "cloudacme:order-id"
+	TagRuleType = "cloudacme:rule-type"
+
+	OwnerCloudAcme = "cloudacme"
+)
+
+const (
+	RuleTypeChallenge       = "challenge"        // fixed response answering a single HTTP-01 challenge
+	RuleTypeTrigger         = "trigger"          // forwards the first request of a domain to the lambda
+	RuleTypeLambdaChallenge = "lambda-challenge" // forwards the challenges of a domain to the lambda, kept between orders
+)
+
+// describeTagsBatchSize is the maximum number of resources DescribeTags accepts
+const describeTagsBatchSize = 20
+
+type orderIdKey struct{}
+
+// WithOrderId returns a context whose rules are tagged with the order id
+func WithOrderId(ctx context.Context, orderId string) context.Context {
+	return context.WithValue(ctx, orderIdKey{}, orderId)
+}
+
+func OrderIdFromContext(ctx context.Context) string {
+	orderId, _ := ctx.Value(orderIdKey{}).(string)
+	return orderId
+}
+
+func ruleTags(ctx context.Context, ruleType string) []types.Tag {
+	tags := []types.Tag{
+		{Key: ptr.String(TagOwner), Value: ptr.String(OwnerCloudAcme)},
+		{Key: ptr.String(TagCreated), Value: ptr.String(time.Now().UTC().Format(time.RFC3339))},
+		{Key: ptr.String(TagRuleType), Value: ptr.String(ruleType)},
+	}
+	if orderId := OrderIdFromContext(ctx); orderId != "" {
+		tags = append(tags, types.Tag{Key: ptr.String(TagOrderId), Value: ptr.String(orderId)})
+	}
+	return tags
+}
+
+// GetTags returns the tags of the load balancer resources, by ARN
+func GetTags(ctx context.Context, resourceArns []string) (map[string]map[string]string, error) {
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
+
+	tags := make(map[string]map[string]string, len(resourceArns))
+	for start := 0; start < len(resourceArns); start += describeTagsBatchSize {
+		end := min(start+describeTagsBatchSize, len(resourceArns))
+		out, err := svc.DescribeTags(ctx, &elbv2.DescribeTagsInput{ResourceArns: resourceArns[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range out.TagDescriptions {
+			m := make(map[string]string, len(desc.Tags))
+			for _, tag := range desc.Tags {
+				m[ptr.ToString(tag.Key)] = ptr.ToString(tag.Value)
+			}
+			tags[ptr.ToString(desc.ResourceArn)] = m
+		}
+	}
+	return tags, nil
+}
@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -27,29 +25,14 @@ type RuleCondition struct {
 }
 
 func DeleteListenerPathRule(ctx context.Context, listenerArn string, target RuleCondition) error {
-	svc := elbv2.NewFromConfig(aws.LoadConfig())
-	searchInput := &elbv2.DescribeRulesInput{
-		ListenerArn: &listenerArn,
-	}
-	rulesOutput, err := svc.DescribeRules(ctx, searchInput)
+	rule, err := FindRule(ctx, listenerArn, target)
 	if err != nil {
 		return err
 	}
-
-	ruleArn := ""
-	for _, rule := range rulesOutput.Rules {
-		if RuleConditionMatches(rule, target) {
-			ruleArn = *rule.RuleArn
-			break
-		}
-	}
-
-	if ruleArn == "" {
-		return ErrRuleNotFound
-	}
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
 
 	input := &elbv2.DeleteRuleInput{
-		RuleArn: &ruleArn,
+		RuleArn: rule.RuleArn,
 	}
 
 	if _, err := svc.DeleteRule(ctx, input); err != nil {
@@ -58,7 +41,22 @@ func DeleteListenerPathRule(ctx context.Context, listenerArn string, target Rule
 	return nil
 }
 
-// TODO: Add unit test
+// FindRule returns the first rule of the listener matching the target conditions, or ErrRuleNotFound
+func FindRule(ctx context.Context, listenerArn string, target RuleCondition) (*types.Rule, error) {
+	rules, err := GetAllRules(ctx, listenerArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if RuleConditionMatches(rule, target) {
+			return &rule, nil
+		}
+	}
+	return nil, ErrRuleNotFound
+}
+
+// RuleConditionMatches reports whether the rule has exactly the path patterns and host headers of target, the
+// conditions target leaves nil are not compared, and no other condition
 func RuleConditionMatches(rule types.Rule, target RuleCondition) bool {
 	// Only path and host header conditions are supported for now
 	for _, cond := range rule.Conditions {
@@ -100,8 +98,8 @@ func RuleConditionMatches(rule types.Rule, target RuleCondition) bool {
 }
 
 // createRuleWithRetry calls CreateRule and retries if a PriorityInUse error is returned,
-// re-fetching the next available priority on each retry.
-func createRuleWithRetry(ctx context.Context, svc *elbv2.Client, listenerArn string, input *elbv2.CreateRuleInput) error {
+// re-fetching a safe priority on each retry.
+func createRuleWithRetry(ctx context.Context, svc *elbv2.Client, listenerArn string, ruleCond RuleCondition, input *elbv2.CreateRuleInput) error {
 	for i := 0; ; i++ {
 		if _, err := svc.CreateRule(ctx, input); err != nil {
 			var apiErr smithy.APIError
@@ -111,7 +109,7 @@ func createRuleWithRetry(ctx context.Context, svc *elbv2.Client, listenerArn str
 				}
 				log.Printf("Priority %d is in use, retrying (%d/%d)...", *input.Priority, i+1, maxPriorityRetries)
 				time.Sleep(time.Second)
-				priority, err := GetNextAvailablePriority(ctx, listenerArn)
+				priority, err := GetSafePriority(ctx, listenerArn, ruleCond)
 				if err != nil {
 					return err
 				}
@@ -124,10 +122,28 @@ func createRuleWithRetry(ctx context.Context, svc *elbv2.Client, listenerArn str
 	}
 }
 
+// ruleConditions returns the path and host conditions of a rule, a rule without hosts matches any host
+func ruleConditions(ruleCond RuleCondition) []types.RuleCondition {
+	conditions := []types.RuleCondition{
+		{
+			Field:             ptr.String("path-pattern"),
+			PathPatternConfig: &types.PathPatternConditionConfig{Values: ruleCond.PathPattern},
+		},
+	}
+	if len(ruleCond.HostHeader) > 0 {
+		conditions = append(conditions, types.RuleCondition{
+			Field:            ptr.String("host-header"),
+			HostHeaderConfig: &types.HostHeaderConditionConfig{Values: ruleCond.HostHeader},
+		})
+	}
+	return conditions
+}
+
+// AddListenerStaticRule adds a fixed response rule answering a challenge, tagged as a challenge rule
 func AddListenerStaticRule(ctx context.Context, listenerArn string, ruleCond RuleCondition, value string) error {
 	svc := elbv2.NewFromConfig(aws.LoadConfig())
 
-	priority, err := GetNextAvailablePriority(ctx, listenerArn)
+	priority, err := GetSafePriority(ctx, listenerArn, ruleCond)
 	if err != nil {
 		return err
 	}
@@ -143,27 +159,20 @@ func AddListenerStaticRule(ctx context.Context, listenerArn string, ruleCond Rul
 				},
 			},
 		},
-		Conditions: []types.RuleCondition{
-			{
-				Field:             ptr.String("path-pattern"),
-				PathPatternConfig: &types.PathPatternConditionConfig{Values: ruleCond.PathPattern},
-			},
-			{
-				Field:            ptr.String("host-header"),
-				HostHeaderConfig: &types.HostHeaderConditionConfig{Values: ruleCond.HostHeader},
-			},
-		},
+		Conditions:  ruleConditions(ruleCond),
 		ListenerArn: &listenerArn,
 		Priority:    ptr.Int32(priority),
+		Tags:        ruleTags(ctx, RuleTypeChallenge),
 	}
 
-	return createRuleWithRetry(ctx, svc, listenerArn, input)
+	return createRuleWithRetry(ctx, svc, listenerArn, ruleCond, input)
 }
 
-func AddListenerTriggerTargetGroupRule(ctx context.Context, listenerArn string, ruleCond RuleCondition, targetArn string) error {
+// AddListenerTriggerTargetGroupRule adds a rule forwarding to the target group, tagged with ruleType
+func AddListenerTriggerTargetGroupRule(ctx context.Context, listenerArn string, ruleCond RuleCondition, targetArn, ruleType string) error {
 	svc := elbv2.NewFromConfig(aws.LoadConfig())
 
-	priority, err := GetNextAvailablePriority(ctx, listenerArn)
+	priority, err := GetSafePriority(ctx, listenerArn, ruleCond)
 	if err != nil {
 		return err
 	}
@@ -175,21 +184,22 @@ func AddListenerTriggerTargetGroupRule(ctx context.Context, listenerArn string,
 				TargetGroupArn: &targetArn,
 			},
 		},
-		Conditions: []types.RuleCondition{
-			{
-				Field:             ptr.String("path-pattern"),
-				PathPatternConfig: &types.PathPatternConditionConfig{Values: ruleCond.PathPattern},
-			},
-			{
-				Field:            ptr.String("host-header"),
-				HostHeaderConfig: &types.HostHeaderConditionConfig{Values: ruleCond.HostHeader},
-			},
-		},
+		Conditions:  ruleConditions(ruleCond),
 		ListenerArn: &listenerArn,
 		Priority:    ptr.Int32(priority),
+		Tags:        ruleTags(ctx, ruleType),
 	}
 
-	return createRuleWithRetry(ctx, svc, listenerArn, input)
+	return createRuleWithRetry(ctx, svc, listenerArn, ruleCond, input)
+}
+
+// DeleteRule deletes the listener rule
+func DeleteRule(ctx context.Context, ruleArn string) error {
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
+	if _, err := svc.DeleteRule(ctx, &elbv2.DeleteRuleInput{RuleArn: &ruleArn}); err != nil {
+		return err
+	}
+	return nil
 }
 
 func GetLambdaTargetGroup(ctx context.Context, lambdaArn string) (string, error) {
@@ -231,26 +241,11 @@ func GetLambdaTargetGroup(ctx context.Context, lambdaArn string) (string, error)
 }
 
 func ModifyListenerRulePathPattern(ctx context.Context, listenerArn string, target RuleCondition, newPathPattern []string) error {
-	svc := elbv2.NewFromConfig(aws.LoadConfig())
-	searchInput := &elbv2.DescribeRulesInput{
-		ListenerArn: &listenerArn,
-	}
-	rulesOutput, err := svc.DescribeRules(ctx, searchInput)
+	rule, err := FindRule(ctx, listenerArn, target)
 	if err != nil {
 		return err
 	}
-
-	ruleArn := ""
-	for _, rule := range rulesOutput.Rules {
-		if RuleConditionMatches(rule, target) {
-			ruleArn = *rule.RuleArn
-			break
-		}
-	}
-
-	if ruleArn == "" {
-		return ErrRuleNotFound
-	}
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
 
 	var conditions []types.RuleCondition
 	if target.HostHeader != nil {
@@ -267,7 +262,7 @@ func ModifyListenerRulePathPattern(ctx context.Context, listenerArn string, targ
 	}
 
 	input := &elbv2.ModifyRuleInput{
-		RuleArn:    &ruleArn,
+		RuleArn:    rule.RuleArn,
 		Conditions: conditions,
 	}
 	if _, err := svc.ModifyRule(ctx, input); err != nil {
@@ -276,45 +271,16 @@ func ModifyListenerRulePathPattern(ctx context.Context, listenerArn string, targ
 	return nil
 }
 
-func GetNextAvailablePriority(ctx context.Context, listenerArn string) (int32, error) {
-	rules, err := GetAllRules(ctx, listenerArn)
-	if err != nil {
-		return 0, err
-	}
-
-	ps := make([]int, 0, len(rules))
-	for _, rule := range rules {
-		if rule.Priority == nil {
-			continue
-		}
-		p, err := strconv.Atoi(*rule.Priority)
-		if err != nil {
-			continue
-		}
-		ps = append(ps, p)
-	}
-	ps = sort.IntSlice(ps)
-	priority := 1
-	for _, p := range ps {
-		if priority == p {
-			priority++
-		} else {
-			break
-		}
-	}
-	return int32(priority), nil
-}
-
 func GetAllRules(ctx context.Context, listenerArn string) ([]types.Rule, error) {
 	svc := elbv2.NewFromConfig(aws.LoadConfig())
 
+	searchInput := &elbv2.DescribeRulesInput{
+		ListenerArn: &listenerArn,
+		PageSize:    ptr.Int32(400),
+	}
+
 	var rules []types.Rule
 	for {
-		searchInput := &elbv2.DescribeRulesInput{
-			ListenerArn: &listenerArn,
-			PageSize:    ptr.Int32(400),
-		}
-
 		searchOuputput, err := svc.DescribeRules(ctx, searchInput)
 		if err != nil {
 			return nil, err
@@ -329,46 +295,164 @@ func GetAllRules(ctx context.Context, listenerArn string) ([]types.Rule, error)
 }
 
 func GetListener(ctx context.Context, albArn string, protocol types.ProtocolEnum, port int32) (*types.Listener, error) {
-	svc := elbv2.NewFromConfig(aws.LoadConfig())
-	input := &elbv2.DescribeListenersInput{
-		LoadBalancerArn: &albArn,
-	}
-
-	result, err := svc.DescribeListeners(ctx, input)
+	listeners, err := GetListeners(ctx, albArn, protocol)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, listener := range result.Listeners {
-		if listener.Protocol == protocol && listener.Port != nil && *listener.Port == port {
+	for _, listener := range listeners {
+		if listener.Port != nil && *listener.Port == port {
 			return &listener, nil
 		}
 	}
 	return nil, errors.New("Listener not found")
 }
 
-func GetAlbCerts(ctx context.Context, albArn string) ([]string, error) {
+// GetListeners returns all the listeners of the ALB with the given protocol, or all of them when protocol is empty
+func GetListeners(ctx context.Context, albArn string, protocol types.ProtocolEnum) ([]types.Listener, error) {
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
+	paginator := elbv2.NewDescribeListenersPaginator(svc, &elbv2.DescribeListenersInput{
+		LoadBalancerArn: &albArn,
+	})
+
+	var listeners []types.Listener
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, listener := range page.Listeners {
+			if protocol == "" || listener.Protocol == protocol {
+				listeners = append(listeners, listener)
+			}
+		}
+	}
+	return listeners, nil
+}
+
+// ListenerCertificate is a certificate attached to an HTTPS listener, either as its default certificate or
+// as an SNI certificate
+type ListenerCertificate struct {
+	ListenerArn    string
+	Port           int32
+	CertificateArn string
+	IsDefault      bool
+}
+
+// GetAlbCerts returns the certificates attached to all HTTPS listeners of the ALB, on any port
+func GetAlbCerts(ctx context.Context, albArn string) ([]ListenerCertificate, error) {
 	albSvc := elbv2.NewFromConfig(aws.LoadConfig())
 
-	listener, err := GetListener(ctx, albArn, types.ProtocolEnumHttps, 443)
+	listeners, err := GetListeners(ctx, albArn, types.ProtocolEnumHttps)
 	if err != nil {
 		return nil, err
 	}
 
+	var certs []ListenerCertificate
+	for _, listener := range listeners {
+		listenerCerts, err := getListenerCerts(ctx, albSvc, listener)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, listenerCerts...)
+	}
+	return certs, nil
+}
+
+// GetCertificatesInUse returns the ARNs of the certificates attached to the HTTPS and TLS listeners of all
+// Application and Network Load Balancers in region, or the default region when empty
+func GetCertificatesInUse(ctx context.Context, region string) (map[string]bool, error) {
+	svc := elbv2.NewFromConfig(aws.LoadConfig(), func(o *elbv2.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	})
+	paginator := elbv2.NewDescribeLoadBalancersPaginator(svc, &elbv2.DescribeLoadBalancersInput{})
+
+	inUse := make(map[string]bool)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range page.LoadBalancers {
+			listeners := elbv2.NewDescribeListenersPaginator(svc, &elbv2.DescribeListenersInput{
+				LoadBalancerArn: lb.LoadBalancerArn,
+			})
+			for listeners.HasMorePages() {
+				listenerPage, err := listeners.NextPage(ctx)
+				if err != nil {
+					return nil, err
+				}
+				for _, listener := range listenerPage.Listeners {
+					if listener.Protocol != types.ProtocolEnumHttps && listener.Protocol != types.ProtocolEnumTls {
+						continue
+					}
+					certs, err := getListenerCerts(ctx, svc, listener)
+					if err != nil {
+						return nil, err
+					}
+					for _, cert := range certs {
+						inUse[cert.CertificateArn] = true
+					}
+				}
+			}
+		}
+	}
+	return inUse, nil
+}
+
+func getListenerCerts(ctx context.Context, svc *elbv2.Client, listener types.Listener) ([]ListenerCertificate, error) {
 	input := &elbv2.DescribeListenerCertificatesInput{
 		ListenerArn: listener.ListenerArn,
 	}
+	var certs []ListenerCertificate
+	for {
+		result, err := svc.DescribeListenerCertificates(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range result.Certificates {
+			certs = append(certs, ListenerCertificate{
+				ListenerArn:    *listener.ListenerArn,
+				Port:           ptr.ToInt32(listener.Port),
+				CertificateArn: *cert.CertificateArn,
+				IsDefault:      ptr.ToBool(cert.IsDefault),
+			})
+		}
+		if result.NextMarker == nil {
+			return certs, nil
+		}
+		input.Marker = result.NextMarker
+	}
+}
 
-	result, err := albSvc.DescribeListenerCertificates(ctx, input)
+// AddListenerCertificate attaches the certificate to the listener as an additional SNI certificate
+func AddListenerCertificate(ctx context.Context, listenerArn, certArn string) error {
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
+	input := &elbv2.AddListenerCertificatesInput{
+		ListenerArn:  &listenerArn,
+		Certificates: []types.Certificate{{CertificateArn: &certArn}},
+	}
+	if _, err := svc.AddListenerCertificates(ctx, input); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLoadBalancer returns the load balancer, including its DNS name
+func GetLoadBalancer(ctx context.Context, albArn string) (*types.LoadBalancer, error) {
+	svc := elbv2.NewFromConfig(aws.LoadConfig())
+	result, err := svc.DescribeLoadBalancers(ctx, &elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: []string{albArn},
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	certArns := make([]string, 0, len(result.Certificates))
-	for _, cert := range result.Certificates {
-		certArns = append(certArns, *cert.CertificateArn)
+	if len(result.LoadBalancers) == 0 {
+		return nil, fmt.Errorf("cannot find load balancer with arn %v", albArn)
 	}
-	return certArns, nil
+	return &result.LoadBalancers[0], nil
 }
 
 func GetTargetGroupAlb(ctx context.Context, targetGroupArn string) (string, error) {
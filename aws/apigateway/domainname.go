@@ -0,0 +1,123 @@
+package apigateway
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigateway"
+	"github.com/aws/aws-sdk-go-v2/service/apigateway/types"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewayv2"
+	typesv2 "github.com/aws/aws-sdk-go-v2/service/apigatewayv2/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+// EdgeCertificateRegion is the region of the certificates of edge optimized domain names
+const EdgeCertificateRegion = "us-east-1"
+
+// DomainName is an API Gateway custom domain name from either the v1 (REST) or v2 (HTTP and WebSocket) API
+type DomainName struct {
+	Name           string
+	Version        int
+	Edge           bool
+	CertificateArn string
+}
+
+// GetDomainName looks up the custom domain name with the given API version, or the v1 then the v2 API when version is 0
+func GetDomainName(ctx context.Context, name string, version int) (*DomainName, error) {
+	if version == 0 || version == 1 {
+		dn, err := getDomainNameV1(ctx, name)
+		var notFoundErr *types.NotFoundException
+		if version == 1 || !errors.As(err, &notFoundErr) {
+			return dn, err
+		}
+	}
+	return getDomainNameV2(ctx, name)
+}
+
+// SetCertificate attaches the certificate to the domain name, if it is not attached already
+func SetCertificate(ctx context.Context, dn *DomainName, certArn string) error {
+	if dn.CertificateArn == certArn {
+		return nil
+	}
+	if dn.Version == 1 {
+		return setCertificateV1(ctx, dn, certArn)
+	}
+	return setCertificateV2(ctx, dn, certArn)
+}
+
+func getDomainNameV1(ctx context.Context, name string) (*DomainName, error) {
+	svc := apigateway.NewFromConfig(aws.LoadConfig())
+	output, err := svc.GetDomainName(ctx, &apigateway.GetDomainNameInput{DomainName: &name})
+	if err != nil {
+		return nil, err
+	}
+
+	dn := &DomainName{Name: name, Version: 1}
+	if output.EndpointConfiguration != nil {
+		for _, t := range output.EndpointConfiguration.Types {
+			if t == types.EndpointTypeEdge {
+				dn.Edge = true
+			}
+		}
+	}
+	if dn.Edge {
+		dn.CertificateArn = ptr.ToString(output.CertificateArn)
+	} else {
+		dn.CertificateArn = ptr.ToString(output.RegionalCertificateArn)
+	}
+	return dn, nil
+}
+
+func setCertificateV1(ctx context.Context, dn *DomainName, certArn string) error {
+	svc := apigateway.NewFromConfig(aws.LoadConfig())
+	path := "/regionalCertificateArn"
+	if dn.Edge {
+		path = "/certificateArn"
+	}
+	_, err := svc.UpdateDomainName(ctx, &apigateway.UpdateDomainNameInput{
+		DomainName: &dn.Name,
+		PatchOperations: []types.PatchOperation{
+			{Op: types.OpReplace, Path: &path, Value: &certArn},
+		},
+	})
+	return err
+}
+
+func getDomainNameV2(ctx context.Context, name string) (*DomainName, error) {
+	svc := apigatewayv2.NewFromConfig(aws.LoadConfig())
+	output, err := svc.GetDomainName(ctx, &apigatewayv2.GetDomainNameInput{DomainName: &name})
+	if err != nil {
+		return nil, err
+	}
+
+	dn := &DomainName{Name: name, Version: 2}
+	if len(output.DomainNameConfigurations) > 0 {
+		dn.CertificateArn = ptr.ToString(output.DomainNameConfigurations[0].CertificateArn)
+	}
+	return dn, nil
+}
+
+func setCertificateV2(ctx context.Context, dn *DomainName, certArn string) error {
+	svc := apigatewayv2.NewFromConfig(aws.LoadConfig())
+	output, err := svc.GetDomainName(ctx, &apigatewayv2.GetDomainNameInput{DomainName: &dn.Name})
+	if err != nil {
+		return err
+	}
+
+	// Only the writable fields of the current configuration are sent back
+	configs := make([]typesv2.DomainNameConfiguration, 0, len(output.DomainNameConfigurations))
+	for _, c := range output.DomainNameConfigurations {
+		configs = append(configs, typesv2.DomainNameConfiguration{
+			CertificateArn:                      &certArn,
+			EndpointType:                        c.EndpointType,
+			SecurityPolicy:                      c.SecurityPolicy,
+			OwnershipVerificationCertificateArn: c.OwnershipVerificationCertificateArn,
+		})
+	}
+	_, err = svc.UpdateDomainName(ctx, &apigatewayv2.UpdateDomainNameInput{
+		DomainName:               &dn.Name,
+		DomainNameConfigurations: configs,
+	})
+	return err
+}
@@ -0,0 +1,130 @@
+package cloudfront
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/ptr"
+)
+
+// CertificateRegion is the only region CloudFront accepts ACM certificates from
+const CertificateRegion = "us-east-1"
+
+const maxUpdateRetries = 5
+
+type Distribution struct {
+	Aliases           []string
+	ACMCertificateArn string
+}
+
+func GetDistribution(ctx context.Context, distributionId string) (*Distribution, error) {
+	svc := cloudfront.NewFromConfig(aws.LoadConfig())
+	output, err := svc.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
+		Id: &distributionId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dist := &Distribution{}
+	if output.DistributionConfig.Aliases != nil {
+		dist.Aliases = output.DistributionConfig.Aliases.Items
+	}
+	if vc := output.DistributionConfig.ViewerCertificate; vc != nil && vc.ACMCertificateArn != nil {
+		dist.ACMCertificateArn = *vc.ACMCertificateArn
+	}
+	return dist, nil
+}
+
+// SetViewerCertificate points the distribution at the ACM certificate. The distribution config is read with
+// its ETag and the update retried if the config was changed concurrently.
+func SetViewerCertificate(ctx context.Context, distributionId, certArn string) error {
+	svc := cloudfront.NewFromConfig(aws.LoadConfig())
+
+	for i := 0; ; i++ {
+		output, err := svc.GetDistributionConfig(ctx, &cloudfront.GetDistributionConfigInput{
+			Id: &distributionId,
+		})
+		if err != nil {
+			return err
+		}
+
+		config := output.DistributionConfig
+		vc := config.ViewerCertificate
+		if vc == nil {
+			vc = &types.ViewerCertificate{}
+			config.ViewerCertificate = vc
+		}
+		if vc.ACMCertificateArn != nil && *vc.ACMCertificateArn == certArn {
+			return nil
+		}
+
+		usedDefaultCertificate := vc.CloudFrontDefaultCertificate != nil && *vc.CloudFrontDefaultCertificate
+		vc.ACMCertificateArn = &certArn
+		vc.CloudFrontDefaultCertificate = ptr.Bool(false)
+		vc.IAMCertificateId = nil
+		vc.Certificate = nil
+		vc.CertificateSource = ""
+		if vc.SSLSupportMethod == "" {
+			vc.SSLSupportMethod = types.SSLSupportMethodSniOnly
+		}
+		if usedDefaultCertificate || vc.MinimumProtocolVersion == "" {
+			vc.MinimumProtocolVersion = types.MinimumProtocolVersionTLSv122021
+		}
+
+		_, err = svc.UpdateDistribution(ctx, &cloudfront.UpdateDistributionInput{
+			Id:                 &distributionId,
+			DistributionConfig: config,
+			IfMatch:            output.ETag,
+		})
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+				if i >= maxUpdateRetries {
+					return fmt.Errorf("failed to update distribution after %d retries: %w", maxUpdateRetries, err)
+				}
+				log.Printf("Distribution %v was modified concurrently, retrying (%d/%d)...", distributionId, i+1, maxUpdateRetries)
+				timer := time.NewTimer(time.Second)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// GetIAMCertificatesInUse returns the IDs of the IAM server certificates used by all distributions
+func GetIAMCertificatesInUse(ctx context.Context) (map[string]bool, error) {
+	svc := cloudfront.NewFromConfig(aws.LoadConfig())
+	paginator := cloudfront.NewListDistributionsPaginator(svc, &cloudfront.ListDistributionsInput{})
+
+	inUse := make(map[string]bool)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if page.DistributionList == nil {
+			continue
+		}
+		for _, dist := range page.DistributionList.Items {
+			if vc := dist.ViewerCertificate; vc != nil && vc.IAMCertificateId != nil {
+				inUse[*vc.IAMCertificateId] = true
+			}
+		}
+	}
+	return inUse, nil
+}
@@ -0,0 +1,24 @@
+package ec2
+
+import (
+	"context"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EnabledRegions returns the regions enabled for the account
+func EnabledRegions(ctx context.Context) ([]string, error) {
+	svc := ec2.NewFromConfig(aws.LoadConfig())
+	output, err := svc.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(output.Regions))
+	for _, region := range output.Regions {
+		if region.RegionName != nil {
+			regions = append(regions, *region.RegionName)
+		}
+	}
+	return regions, nil
+}
@@ -0,0 +1,46 @@
+package elb
+
+import (
+	"context"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancing"
+)
+
+// SetListenerCertificate replaces the certificate of the HTTPS or SSL listener of a Classic Load Balancer
+func SetListenerCertificate(ctx context.Context, loadBalancerName string, port int32, certArn string) error {
+	svc := elb.NewFromConfig(aws.LoadConfig())
+	_, err := svc.SetLoadBalancerListenerSSLCertificate(ctx, &elb.SetLoadBalancerListenerSSLCertificateInput{
+		LoadBalancerName: &loadBalancerName,
+		LoadBalancerPort: port,
+		SSLCertificateId: &certArn,
+	})
+	return err
+}
+
+// GetCertificatesInUse returns the ARNs of the certificates used by the listeners of all Classic Load Balancers
+// in region, or the default region when empty
+func GetCertificatesInUse(ctx context.Context, region string) (map[string]bool, error) {
+	svc := elb.NewFromConfig(aws.LoadConfig(), func(o *elb.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	})
+	paginator := elb.NewDescribeLoadBalancersPaginator(svc, &elb.DescribeLoadBalancersInput{})
+
+	inUse := make(map[string]bool)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range page.LoadBalancerDescriptions {
+			for _, ld := range lb.ListenerDescriptions {
+				if ld.Listener != nil && ld.Listener.SSLCertificateId != nil {
+					inUse[*ld.Listener.SSLCertificateId] = true
+				}
+			}
+		}
+	}
+	return inUse, nil
+}
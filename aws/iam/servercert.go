@@ -0,0 +1,96 @@
+package iam
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrInUse is returned when deleting a server certificate that is still used by a load balancer or another service
+var ErrInUse = errors.New("server certificate is in use")
+
+type ServerCertificate struct {
+	Name string
+	Id   string
+	Arn  string
+}
+
+func UploadServerCertificate(ctx context.Context, name, path string, certPem, chainPem, keyPem []byte) (*ServerCertificate, error) {
+	svc := iam.NewFromConfig(aws.LoadConfig())
+	input := &iam.UploadServerCertificateInput{
+		ServerCertificateName: &name,
+		Path:                  &path,
+		CertificateBody:       stringPtr(certPem),
+		PrivateKey:            stringPtr(keyPem),
+	}
+	if len(chainPem) > 0 {
+		input.CertificateChain = stringPtr(chainPem)
+	}
+
+	output, err := svc.UploadServerCertificate(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerCertificate{
+		Name: *output.ServerCertificateMetadata.ServerCertificateName,
+		Id:   *output.ServerCertificateMetadata.ServerCertificateId,
+		Arn:  *output.ServerCertificateMetadata.Arn,
+	}, nil
+}
+
+func GetServerCertificate(ctx context.Context, name string) (*ServerCertificate, error) {
+	svc := iam.NewFromConfig(aws.LoadConfig())
+	output, err := svc.GetServerCertificate(ctx, &iam.GetServerCertificateInput{
+		ServerCertificateName: &name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	metadata := output.ServerCertificate.ServerCertificateMetadata
+	return &ServerCertificate{Name: *metadata.ServerCertificateName, Id: *metadata.ServerCertificateId, Arn: *metadata.Arn}, nil
+}
+
+func ListServerCertificates(ctx context.Context, pathPrefix string) ([]ServerCertificate, error) {
+	svc := iam.NewFromConfig(aws.LoadConfig())
+	paginator := iam.NewListServerCertificatesPaginator(svc, &iam.ListServerCertificatesInput{
+		PathPrefix: &pathPrefix,
+	})
+
+	var certs []ServerCertificate
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range page.ServerCertificateMetadataList {
+			certs = append(certs, ServerCertificate{Name: *metadata.ServerCertificateName, Id: *metadata.ServerCertificateId, Arn: *metadata.Arn})
+		}
+	}
+	return certs, nil
+}
+
+func DeleteServerCertificate(ctx context.Context, name string) error {
+	svc := iam.NewFromConfig(aws.LoadConfig())
+	_, err := svc.DeleteServerCertificate(ctx, &iam.DeleteServerCertificateInput{
+		ServerCertificateName: &name,
+	})
+	var conflictErr *types.DeleteConflictException
+	if errors.As(err, &conflictErr) {
+		return ErrInUse
+	}
+	return err
+}
+
+func IsAlreadyExists(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityAlreadyExists"
+}
+
+func stringPtr(b []byte) *string {
+	s := string(b)
+	return &s
+}
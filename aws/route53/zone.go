@@ -0,0 +1,208 @@
+package route53
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go/ptr"
+)
+
+var ErrZoneNotFound = errors.New("hosted zone not found")
+
+type HostedZone struct {
+	Id          string
+	Name        string // fully qualified, with the trailing dot
+	NameServers []string
+}
+
+// Client calls the Route53 API, or the API at Endpoint when it is set, such as a local Route53 stand-in
+type Client struct {
+	Endpoint string
+}
+
+func (c Client) newClient() *route53.Client {
+	return route53.NewFromConfig(aws.LoadConfig(), func(o *route53.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = &c.Endpoint
+		}
+	})
+}
+
+// FindHostedZone returns the public hosted zone with the longest name that name belongs to
+func (c Client) FindHostedZone(ctx context.Context, name string) (*HostedZone, error) {
+	svc := c.newClient()
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".") + "."
+		output, err := svc.ListHostedZonesByName(ctx, &route53.ListHostedZonesByNameInput{
+			DNSName:  &candidate,
+			MaxItems: ptr.Int32(10),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Zones are sorted by name, the ones with the candidate name come first
+		for _, zone := range output.HostedZones {
+			if !strings.EqualFold(ptr.ToString(zone.Name), candidate) {
+				break
+			}
+			if zone.Config != nil && zone.Config.PrivateZone {
+				continue
+			}
+			return c.GetHostedZone(ctx, ptr.ToString(zone.Id))
+		}
+	}
+	return nil, fmt.Errorf("%w for %v", ErrZoneNotFound, name)
+}
+
+func (c Client) GetHostedZone(ctx context.Context, zoneId string) (*HostedZone, error) {
+	svc := c.newClient()
+
+	output, err := svc.GetHostedZone(ctx, &route53.GetHostedZoneInput{Id: &zoneId})
+	if err != nil {
+		return nil, err
+	}
+	zone := &HostedZone{
+		Id:   strings.TrimPrefix(ptr.ToString(output.HostedZone.Id), "/hostedzone/"),
+		Name: ptr.ToString(output.HostedZone.Name),
+	}
+	if output.DelegationSet != nil {
+		zone.NameServers = output.DelegationSet.NameServers
+	}
+	return zone, nil
+}
+
+// GetTXTValues returns the unquoted values of the TXT record name in the zone, none when it does not exist
+func (c Client) GetTXTValues(ctx context.Context, zoneId, name string) ([]string, error) {
+	svc := c.newClient()
+
+	name = fqdn(name)
+	output, err := svc.ListResourceRecordSets(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    &zoneId,
+		StartRecordName: &name,
+		StartRecordType: types.RRTypeTxt,
+		MaxItems:        ptr.Int32(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, rrs := range output.ResourceRecordSets {
+		if rrs.Type != types.RRTypeTxt || !strings.EqualFold(ptr.ToString(rrs.Name), name) {
+			continue
+		}
+		for _, rr := range rrs.ResourceRecords {
+			value, err := parseTXTValue(ptr.ToString(rr.Value))
+			if err != nil {
+				return nil, fmt.Errorf("unexpected TXT value %v: %w", ptr.ToString(rr.Value), err)
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// SetTXTValues replaces the values of the TXT record name, old are the current values, which are needed to
+// delete the record when values is empty. The ID of the change is returned.
+func (c Client) SetTXTValues(ctx context.Context, zoneId, name string, old, values []string, ttl int64) (string, error) {
+	svc := c.newClient()
+
+	action := types.ChangeActionUpsert
+	if len(values) == 0 {
+		if len(old) == 0 {
+			return "", nil
+		}
+		action = types.ChangeActionDelete
+		values = old
+	}
+
+	rrs := &types.ResourceRecordSet{
+		Name: ptr.String(fqdn(name)),
+		Type: types.RRTypeTxt,
+		TTL:  &ttl,
+	}
+	for _, value := range values {
+		rrs.ResourceRecords = append(rrs.ResourceRecords, types.ResourceRecord{Value: ptr.String(quoteTXTValue(value))})
+	}
+
+	output, err := svc.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: &zoneId,
+		ChangeBatch: &types.ChangeBatch{
+			Comment: ptr.String("cloudacme DNS-01 challenge"),
+			Changes: []types.Change{{Action: action, ResourceRecordSet: rrs}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return ptr.ToString(output.ChangeInfo.Id), nil
+}
+
+// WaitForChange waits until the change has been applied to all Route53 name servers
+func (c Client) WaitForChange(ctx context.Context, changeId string, timeout time.Duration) error {
+	waiter := route53.NewResourceRecordSetsChangedWaiter(c.newClient(), func(o *route53.ResourceRecordSetsChangedWaiterOptions) {
+		o.MinDelay = 2 * time.Second
+		o.MaxDelay = 10 * time.Second
+	})
+	return waiter.Wait(ctx, &route53.GetChangeInput{Id: &changeId}, timeout)
+}
+
+// maxTXTString is the length limit of a character-string of a TXT value
+const maxTXTString = 255
+
+// parseTXTValue returns the text of a TXT value as Route53 presents it, one or more quoted character-strings
+// separated by spaces, such as "abc" "def", which are joined
+func parseTXTValue(value string) (string, error) {
+	var text strings.Builder
+	rest := strings.TrimSpace(value)
+	if rest == "" {
+		return "", errors.New("empty value")
+	}
+	for rest != "" {
+		if rest[0] != '"' {
+			return "", errors.New("character-string is not quoted")
+		}
+		end := 1
+		for ; end < len(rest) && rest[end] != '"'; end++ {
+			if rest[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(rest) {
+			return "", errors.New("character-string is not terminated")
+		}
+		segment, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(segment)
+		rest = strings.TrimLeft(rest[end+1:], " ")
+	}
+	return text.String(), nil
+}
+
+// quoteTXTValue returns the TXT value for text, split in character-strings of at most 255 bytes
+func quoteTXTValue(text string) string {
+	var segments []string
+	for len(text) > maxTXTString {
+		segments = append(segments, strconv.Quote(text[:maxTXTString]))
+		text = text[maxTXTString:]
+	}
+	return strings.Join(append(segments, strconv.Quote(text)), " ")
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
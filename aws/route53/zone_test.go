@@ -0,0 +1,49 @@
+package route53
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTXTValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{`"abc"`, "abc", false},
+		{`"abc" "def"`, "abcdef", false},
+		{`"v=spf1 include:example.com " "~all"`, "v=spf1 include:example.com ~all", false},
+		{`"a \"quoted\" word" "\\"`, `a "quoted" word\`, false},
+		{`"\101bc"`, "Abc", false},
+		{`""`, "", false},
+		{`abc`, "", true},
+		{`"abc`, "", true},
+		{`"abc" def`, "", true},
+		{``, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseTXTValue(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTXTValue(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTXTValue(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteTXTValue(t *testing.T) {
+	if got := quoteTXTValue("abc"); got != `"abc"` {
+		t.Errorf("quoteTXTValue() = %v", got)
+	}
+	long := strings.Repeat("a", 300)
+	got := quoteTXTValue(long)
+	if want := `"` + long[:255] + `" "` + long[255:] + `"`; got != want {
+		t.Errorf("quoteTXTValue() = %v, want it split at 255 bytes", got)
+	}
+	if text, err := parseTXTValue(got); err != nil || text != long {
+		t.Errorf("parseTXTValue(quoteTXTValue()) = %v, %v", text, err)
+	}
+}
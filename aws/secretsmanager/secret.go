@@ -0,0 +1,24 @@
+package secretsmanager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DefangLabs/cloudacme/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// GetSecretString returns the current value of the secret, given by name or ARN
+func GetSecretString(ctx context.Context, secretId string) (string, error) {
+	client := secretsmanager.NewFromConfig(aws.LoadConfig())
+	result, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: &secretId,
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.SecretString == nil {
+		return "", errors.New("secret has no string value")
+	}
+	return *result.SecretString, nil
+}
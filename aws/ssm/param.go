@@ -33,3 +33,70 @@ func PutParameter(ctx context.Context, name string, value string) error {
 	_, err := client.PutParameter(ctx, input)
 	return err
 }
+
+// PutSecureParameter stores value as a SecureString encrypted with the given KMS key, or the
+// account default key when kmsKeyId is empty. Intelligent tiering lets values above the 4KB
+// standard tier limit, such as certificate chains, be stored.
+func PutSecureParameter(ctx context.Context, name, value, kmsKeyId string) error {
+	client := ssm.NewFromConfig(aws.LoadConfig())
+	input := &ssm.PutParameterInput{
+		Name:      &name,
+		Value:     &value,
+		Type:      types.ParameterTypeSecureString,
+		Tier:      types.ParameterTierIntelligentTiering,
+		Overwrite: ptr.Bool(true),
+	}
+	if kmsKeyId != "" {
+		input.KeyId = &kmsKeyId
+	}
+	_, err := client.PutParameter(ctx, input)
+	return err
+}
+
+// ParameterVersion is a retained version of a parameter with its decrypted value
+type ParameterVersion struct {
+	Version int64
+	Value   string
+	Labels  []string
+}
+
+// GetParameterHistory returns all retained versions of a parameter, oldest first.
+func GetParameterHistory(ctx context.Context, name string) ([]ParameterVersion, error) {
+	client := ssm.NewFromConfig(aws.LoadConfig())
+	paginator := ssm.NewGetParameterHistoryPaginator(client, &ssm.GetParameterHistoryInput{
+		Name:           &name,
+		WithDecryption: ptr.Bool(true),
+	})
+
+	var versions []ParameterVersion
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Parameters {
+			if p.Value != nil {
+				versions = append(versions, ParameterVersion{Version: p.Version, Value: *p.Value, Labels: p.Labels})
+			}
+		}
+	}
+	return versions, nil
+}
+
+// LabelParameterVersion attaches the label to a version of the parameter, moving it from the version it was
+// attached to before
+func LabelParameterVersion(ctx context.Context, name string, version int64, label string) error {
+	client := ssm.NewFromConfig(aws.LoadConfig())
+	_, err := client.LabelParameterVersion(ctx, &ssm.LabelParameterVersionInput{
+		Name:             &name,
+		ParameterVersion: &version,
+		Labels:           []string{label},
+	})
+	return err
+}
+
+func DeleteParameter(ctx context.Context, name string) error {
+	client := ssm.NewFromConfig(aws.LoadConfig())
+	_, err := client.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: &name})
+	return err
+}
@@ -0,0 +1,170 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const DefaultBaseURL = "https://api.cloudflare.com/client/v4"
+
+var ErrZoneNotFound = errors.New("zone not found")
+
+type Zone struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	NameServers []string `json:"name_servers"`
+}
+
+type DNSRecord struct {
+	Id      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Client calls the Cloudflare API with an API token, at BaseURL when set, such as a local stand-in of the API
+type Client struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type resultInfo struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type response struct {
+	Success    bool            `json:"success"`
+	Errors     []apiError      `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *resultInfo     `json:"result_info"`
+}
+
+// FindZone returns the active zone with the longest name that name belongs to
+func (c Client) FindZone(ctx context.Context, name string) (*Zone, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		var zones []Zone
+		query := url.Values{"name": {candidate}, "status": {"active"}}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+query.Encode(), nil, &zones); err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			return &zones[0], nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %v", ErrZoneNotFound, name)
+}
+
+func (c Client) GetZone(ctx context.Context, zoneId string) (*Zone, error) {
+	var zone Zone
+	if err := c.do(ctx, http.MethodGet, "/zones/"+url.PathEscape(zoneId), nil, &zone); err != nil {
+		return nil, err
+	}
+	return &zone, nil
+}
+
+// ListTXTRecords returns the TXT records with the given name in the zone, from all the pages of results
+func (c Client) ListTXTRecords(ctx context.Context, zoneId, name string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(name, ".")}, "per_page": {"100"}}
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var pageRecords []DNSRecord
+		info, err := c.doInfo(ctx, http.MethodGet, "/zones/"+url.PathEscape(zoneId)+"/dns_records?"+query.Encode(), nil, &pageRecords)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, pageRecords...)
+		if info == nil || page >= info.TotalPages || len(pageRecords) == 0 {
+			return records, nil
+		}
+	}
+}
+
+func (c Client) CreateDNSRecord(ctx context.Context, zoneId string, record DNSRecord) (*DNSRecord, error) {
+	var created DNSRecord
+	if err := c.do(ctx, http.MethodPost, "/zones/"+url.PathEscape(zoneId)+"/dns_records", record, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c Client) DeleteDNSRecord(ctx context.Context, zoneId, recordId string) error {
+	return c.do(ctx, http.MethodDelete, "/zones/"+url.PathEscape(zoneId)+"/dns_records/"+url.PathEscape(recordId), nil, nil)
+}
+
+func (c Client) do(ctx context.Context, method, path string, body, result any) error {
+	_, err := c.doInfo(ctx, method, path, body, result)
+	return err
+}
+
+// doInfo calls the API and decodes the result into result, returning the paging information of list results
+func (c Client) doInfo(ctx context.Context, method, path string, body, result any) (*resultInfo, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%v %v: unexpected response with status %v: %w", method, path, resp.Status, err)
+	}
+	if !r.Success {
+		msgs := make([]string, 0, len(r.Errors))
+		for _, e := range r.Errors {
+			msgs = append(msgs, fmt.Sprintf("%v (code %d)", e.Message, e.Code))
+		}
+		return nil, fmt.Errorf("%v %v failed with status %v: %v", method, strings.SplitN(path, "?", 2)[0], resp.Status, strings.Join(msgs, ", "))
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return nil, err
+		}
+	}
+	return r.ResultInfo, nil
+}
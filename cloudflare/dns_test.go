@@ -0,0 +1,248 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "test-token"
+
+// fakeAPI is a stand-in of the zones and DNS records endpoints of the Cloudflare API
+type fakeAPI struct {
+	mu       sync.Mutex
+	zones    []Zone
+	records  map[string][]DNSRecord // by zone id
+	pageSize int
+	nextId   int
+	requests []string
+}
+
+func newFakeAPI(t *testing.T, zones ...Zone) (*fakeAPI, Client) {
+	t.Helper()
+	api := &fakeAPI{zones: zones, records: map[string][]DNSRecord{}, pageSize: 100}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, Client{Token: testToken, BaseURL: srv.URL, HTTPClient: srv.Client()}
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		writeError(w, http.StatusForbidden, 9109, "Invalid access token")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "zones":
+		zones := []Zone{}
+		for _, z := range api.zones {
+			if z.Name == query.Get("name") {
+				zones = append(zones, z)
+			}
+		}
+		writeResult(w, zones, nil)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "zones":
+		for _, z := range api.zones {
+			if z.Id == parts[1] {
+				writeResult(w, z, nil)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, 7003, "Could not route to /zones/"+parts[1])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "dns_records":
+		var matching []DNSRecord
+		for _, rec := range api.records[parts[1]] {
+			if rec.Type == query.Get("type") && rec.Name == query.Get("name") {
+				matching = append(matching, rec)
+			}
+		}
+		page, _ := strconv.Atoi(query.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		totalPages := (len(matching) + api.pageSize - 1) / api.pageSize
+		start := min((page-1)*api.pageSize, len(matching))
+		end := min(start+api.pageSize, len(matching))
+		writeResult(w, append([]DNSRecord{}, matching[start:end]...), &resultInfo{Page: page, TotalPages: totalPages})
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "dns_records":
+		var rec DNSRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			writeError(w, http.StatusBadRequest, 9207, "Request body is invalid")
+			return
+		}
+		api.nextId++
+		rec.Id = fmt.Sprintf("rec%d", api.nextId)
+		api.records[parts[1]] = append(api.records[parts[1]], rec)
+		writeResult(w, rec, nil)
+	case r.Method == http.MethodDelete && len(parts) == 4 && parts[2] == "dns_records":
+		records := api.records[parts[1]]
+		for i, rec := range records {
+			if rec.Id == parts[3] {
+				api.records[parts[1]] = append(records[:i], records[i+1:]...)
+				writeResult(w, map[string]string{"id": rec.Id}, nil)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, 81044, "Record does not exist.")
+	default:
+		writeError(w, http.StatusNotFound, 7000, "No route for that URI")
+	}
+}
+
+func writeResult(w http.ResponseWriter, result any, info *resultInfo) {
+	data, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(response{Success: true, Errors: []apiError{}, Result: data, ResultInfo: info})
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response{Errors: []apiError{{Code: code, Message: message}}, Result: json.RawMessage("null")})
+}
+
+func TestFindZone(t *testing.T) {
+	_, client := newFakeAPI(t,
+		Zone{Id: "z1", Name: "example.com", NameServers: []string{"ns1.example.net"}},
+		Zone{Id: "z2", Name: "eu.example.com"},
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "z1"},
+		{"_acme-challenge.www.example.com.", "z1"},
+		{"_acme-challenge.eu.example.com", "z2"},
+		{"_acme-challenge.api.eu.example.com.", "z2"},
+		{"_acme-challenge.example.org", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone, err := client.FindZone(ctx, tt.name)
+			if tt.want == "" {
+				if !errors.Is(err, ErrZoneNotFound) {
+					t.Fatalf("FindZone() = %v, %v, want ErrZoneNotFound", zone, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindZone() error = %v", err)
+			}
+			if zone.Id != tt.want {
+				t.Errorf("FindZone() = %v, want %v", zone.Id, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	api, client := newFakeAPI(t, Zone{Id: "z1", Name: "example.com"})
+	ctx := context.Background()
+	const name = "_acme-challenge.example.com"
+
+	created, err := client.CreateDNSRecord(ctx, "z1", DNSRecord{Type: "TXT", Name: name, Content: `"one"`, TTL: 60})
+	if err != nil {
+		t.Fatalf("CreateDNSRecord() error = %v", err)
+	}
+	if created.Id == "" || created.Content != `"one"` {
+		t.Errorf("CreateDNSRecord() = %+v", created)
+	}
+	if _, err := client.CreateDNSRecord(ctx, "z1", DNSRecord{Type: "TXT", Name: "other.example.com", Content: `"two"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := client.ListTXTRecords(ctx, "z1", name+".")
+	if err != nil {
+		t.Fatalf("ListTXTRecords() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Id != created.Id {
+		t.Errorf("ListTXTRecords() = %+v, want the record with the name", records)
+	}
+
+	if err := client.DeleteDNSRecord(ctx, "z1", created.Id); err != nil {
+		t.Fatalf("DeleteDNSRecord() error = %v", err)
+	}
+	if records, _ := client.ListTXTRecords(ctx, "z1", name); len(records) != 0 {
+		t.Errorf("ListTXTRecords() after delete = %+v", records)
+	}
+	if len(api.records["z1"]) != 1 {
+		t.Errorf("records of zone = %+v, want the other record kept", api.records["z1"])
+	}
+}
+
+func TestListTXTRecordsPages(t *testing.T) {
+	api, client := newFakeAPI(t, Zone{Id: "z1", Name: "example.com"})
+	api.pageSize = 2
+	ctx := context.Background()
+	const name = "_acme-challenge.example.com"
+	for i := range 5 {
+		if _, err := client.CreateDNSRecord(ctx, "z1", DNSRecord{Type: "TXT", Name: name, Content: strconv.Quote(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api.requests = nil
+	records, err := client.ListTXTRecords(ctx, "z1", name)
+	if err != nil {
+		t.Fatalf("ListTXTRecords() error = %v", err)
+	}
+	if len(records) != 5 {
+		t.Errorf("ListTXTRecords() = %d records, want 5", len(records))
+	}
+	for i, r := range records {
+		if r.Content != strconv.Quote(strconv.Itoa(i)) {
+			t.Errorf("record %d = %v", i, r.Content)
+		}
+	}
+	if len(api.requests) != 3 {
+		t.Errorf("requests = %v, want 3 pages", api.requests)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, client := newFakeAPI(t, Zone{Id: "z1", Name: "example.com"})
+	ctx := context.Background()
+
+	if err := client.DeleteDNSRecord(ctx, "z1", "missing"); err == nil || !strings.Contains(err.Error(), "Record does not exist. (code 81044)") {
+		t.Errorf("DeleteDNSRecord() error = %v, want the API error", err)
+	}
+	if _, err := client.GetZone(ctx, "z9"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("GetZone() error = %v, want the status", err)
+	}
+
+	unauthorized := client
+	unauthorized.Token = "wrong"
+	if _, err := unauthorized.FindZone(ctx, "example.com"); err == nil || errors.Is(err, ErrZoneNotFound) || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("FindZone() error = %v, want the API error", err)
+	}
+
+	// an error envelope with a 200 status
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":false,"errors":[{"code":1000,"message":"first"},{"code":1001,"message":"second"}],"result":null}`))
+	}))
+	defer srv.Close()
+	if _, err := (Client{BaseURL: srv.URL}).GetZone(ctx, "z1"); err == nil || !strings.Contains(err.Error(), "first (code 1000), second (code 1001)") {
+		t.Errorf("GetZone() error = %v, want all the errors", err)
+	}
+
+	// a response that is not an API envelope, like an error page of a proxy
+	html := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>Bad gateway</html>", http.StatusBadGateway)
+	}))
+	defer html.Close()
+	if _, err := (Client{BaseURL: html.URL}).GetZone(ctx, "z1"); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("GetZone() error = %v, want the status", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/spf13/pflag"
+)
+
+func bootstrap(args []string) {
+	flags := pflag.NewFlagSet("bootstrap", pflag.ExitOnError)
+	var domains *[]string = flags.StringSlice("domain", nil, "Domains to bootstrap, repeated or comma separated, the first one identifies the certificate")
+	var albArn *string = flags.String("alb-arn", "", "ARN of the ALB serving the domain")
+	var lambdaArn *string = flags.String("lambda-arn", "", "ARN of the cloudacme lambda function to trigger from the ALB")
+	var rulePriorityBand *string = flags.String("rule-priority-band", "", "Range of listener rule priorities reserved for the trigger rules, such as 100-199")
+	flags.Parse(args)
+
+	if len(*domains) == 0 {
+		log.Fatalf("domain is required")
+	}
+
+	if *albArn == "" {
+		log.Fatalf("alb-arn is required")
+	}
+
+	if *lambdaArn == "" {
+		log.Fatalf("lambda-arn is required")
+	}
+
+	band, err := alb.ParsePriorityBand(*rulePriorityBand)
+	if err != nil {
+		log.Fatalf("invalid rule-priority-band: %v", err)
+	}
+
+	ctx := alb.WithPriorityBand(context.Background(), band)
+	if err := acme.Bootstrap(ctx, *albArn, *lambdaArn, *domains); err != nil {
+		log.Fatalf("Failed to bootstrap %v: %v", *domains, err)
+	}
+	log.Printf("Domains %v are ready for their first certificate issuance", *domains)
+}
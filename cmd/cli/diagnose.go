@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/DefangLabs/cloudacme/solver"
+	"github.com/spf13/pflag"
+)
+
+// diagnose runs the checks done before ordering, without placing an order, and reports every problem found
+func diagnose(args []string) {
+	flags := pflag.NewFlagSet("diagnose", pflag.ExitOnError)
+	var domains *[]string = flags.StringSlice("domain", nil, "Domains to check, repeated or comma separated")
+	var acmeDirectory *string = flags.String("directory", acme.DefaultAcmeDirectory, "ACME directory URL of the CA to check the CAA records for")
+	var accountURI *string = flags.String("account-uri", "", "ACME account URL to check accounturi parameters of CAA records against, not checked if not provided")
+	var challengeTypes *[]string = flags.StringSlice("challenge-types", []string{"http-01"}, "Challenge types to check validationmethods parameters of CAA records against")
+	var albArn *string = flags.String("alb-arn", "", "ARN of the ALB the domains should point at, not checked if not provided")
+	var dnsResolvers *[]string = flags.StringSlice("dns-resolvers", nil, "Resolvers, as host or host:port, to look up the records with, the system resolvers if not provided")
+	flags.Parse(args)
+
+	if len(*domains) == 0 {
+		log.Fatalf("domain is required")
+	}
+
+	ctx := context.Background()
+	failed := false
+
+	identities, err := acme.CAAIdentities(ctx, *acmeDirectory)
+	if err != nil {
+		log.Fatalf("Failed to get CAA identities: %v", err)
+	}
+	log.Printf("CA of %v is identified by %v in CAA records", *acmeDirectory, identities)
+
+	policy := acme.CAAPolicy{Identities: identities, AccountURI: *accountURI, Methods: *challengeTypes}
+	results, err := policy.Evaluate(ctx, *domains, *dnsResolvers)
+	if err != nil {
+		log.Fatalf("Failed to look up CAA records: %v", err)
+	}
+	for _, r := range results {
+		if r.Set.Name != "" {
+			log.Printf("CAA records of %v found at %v: %v", r.Domain, r.Set.Name, r.Set.Records)
+		}
+		if r.Permitted {
+			log.Printf("OK   CAA %v, challenge types %v: %v", r.Domain, r.Methods, r.Reason)
+		} else {
+			log.Printf("FAIL CAA %v: %v", r.Domain, r.Reason)
+			failed = true
+		}
+	}
+
+	if *albArn != "" {
+		check := solver.AlbHttp01Solver{AlbArn: *albArn, Resolvers: *dnsResolvers}
+		if err := check.Preflight(ctx, *domains); err != nil {
+			log.Printf("FAIL DNS %v", err)
+			failed = true
+		} else {
+			log.Printf("OK   DNS all domains point at the ALB")
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/spf13/pflag"
+)
+
+func gc(args []string) {
+	flags := pflag.NewFlagSet("gc", pflag.ExitOnError)
+	var albArns *[]string = flags.StringSlice("alb-arn", nil, "ARN of the ALB to delete stale cloudacme rules from, repeated or comma separated")
+	var challengeMaxAge *time.Duration = flags.Duration("challenge-max-age", acme.DefaultChallengeMaxAge, "Age after which a challenge rule is deleted")
+	var triggerMaxAge *time.Duration = flags.Duration("trigger-max-age", acme.DefaultTriggerMaxAge, "Age after which a trigger rule forwarding the first request of a domain to the lambda is deleted")
+	var includeUntagged *bool = flags.Bool("include-untagged", false, "Also delete untagged fixed response rules on challenge paths, left by older versions, only when no order is running")
+	var dryRun *bool = flags.Bool("dry-run", false, "List the stale rules without deleting them")
+	flags.Parse(args)
+
+	if len(*albArns) == 0 {
+		log.Fatalf("alb-arn is required")
+	}
+
+	collector := acme.RuleCollector{
+		ChallengeMaxAge: *challengeMaxAge,
+		TriggerMaxAge:   *triggerMaxAge,
+		IncludeUntagged: *includeUntagged,
+		DryRun:          *dryRun,
+	}
+	failed := false
+	for _, albArn := range *albArns {
+		stale, err := collector.Collect(context.Background(), albArn)
+		if err != nil {
+			log.Printf("Failed to collect stale rules of %v: %v", albArn, err)
+			failed = true
+		}
+		log.Printf("Found %d stale rules on %v", len(stale), albArn)
+	}
+	if failed {
+		log.Fatalf("Failed to delete some stale rules")
+	}
+}
@@ -2,10 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/DefangLabs/cloudacme/acme"
-	"github.com/DefangLabs/cloudacme/aws/acm"
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/DefangLabs/cloudacme/aws/cloudfront"
+	"github.com/DefangLabs/cloudacme/aws/secretsmanager"
+	"github.com/DefangLabs/cloudacme/aws/ssm"
+	"github.com/DefangLabs/cloudacme/cloudflare"
+	"github.com/DefangLabs/cloudacme/export"
+	"github.com/DefangLabs/cloudacme/solver"
+	"github.com/DefangLabs/cloudacme/target"
+	"github.com/mholt/acmez"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
@@ -13,28 +24,233 @@ import (
 var version = "dev" // to be set by ldflags
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rollback":
+			rollback(os.Args[2:])
+			return
+		case "bootstrap":
+			bootstrap(os.Args[2:])
+			return
+		case "gc":
+			gc(os.Args[2:])
+			return
+		case "diagnose":
+			diagnose(os.Args[2:])
+			return
+		}
+	}
 
 	var debug *bool = pflag.Bool("debug", false, "Enable debug logging")
 	var certArn *string = pflag.String("cert-arn", "", "ARN of the certificate to reimport to")
+	var createIfMissing *bool = pflag.Bool("create-if-missing", false, "When cert-arn is not provided, import a new certificate and attach it to the ALB HTTPS listener if none is attached for the domain")
 	var accountKeyFile *string = pflag.String("account-key-file", "./acme_account_key.pem", "Path to the account key file in PEM format, a new key will be generated and saved to this path if it does not exist")
 	var accountKeySSM *string = pflag.String("account-key-ssm", "", "Name of the AWS SSM parameter to load from and store the account key to, if not provided the key will be saved to local file")
 	var acmeDirectory *string = pflag.String("directory", acme.DefaultAcmeDirectory, "ACME directory URL")
-	var domain *string = pflag.String("domain", "", "Domain to request certificate for")
+	var domains *[]string = pflag.StringSlice("domain", nil, "Domains to request the certificate for, repeated or comma separated, the first one identifies the certificate")
 	var albArn *string = pflag.String("alb-arn", "", "ARN of the ALB to update")
+	var certHistorySSM *string = pflag.String("cert-history-ssm", "", "SSM parameter prefix to save imported certificates and keys under for rollback, history is not kept if not provided")
+	var certHistoryKmsKey *string = pflag.String("cert-history-kms-key", "", "KMS key to encrypt the certificate history with, the account default key is used if not provided")
+	var certFile *string = pflag.String("cert-file", "", "Path to write the certificate to in PEM format")
+	var chainFile *string = pflag.String("chain-file", "", "Path to write the intermediate certificates to in PEM format")
+	var fullchainFile *string = pflag.String("fullchain-file", "", "Path to write the certificate followed by the intermediate certificates to in PEM format")
+	var keyFile *string = pflag.String("key-file", "", "Path to write the private key to in PEM format")
+	var pkcs12File *string = pflag.String("pkcs12-file", "", "Path to write the certificate chain and private key to as a PKCS#12 bundle")
+	var cloudFrontDistributionId *string = pflag.String("cloudfront-distribution-id", "", "ID of a CloudFront distribution to import the certificate for in us-east-1 and set as its viewer certificate")
+	var apiGatewayDomain *string = pflag.String("apigateway-domain", "", "API Gateway custom domain name to import the certificate for and attach it to")
+	var apiGatewayVersion *int = pflag.Int("apigateway-version", 0, "API Gateway API version of the custom domain name, 1 or 2, detected if not provided")
+	var iamServerCertificateName *string = pflag.String("iam-server-certificate-name", "", "Base name of the IAM server certificate to upload the certificate as, versions are named <name>-<timestamp>")
+	var iamPath *string = pflag.String("iam-path", target.DefaultIAMPath, "IAM path of the server certificates")
+	var classicElbListeners *[]string = pflag.StringSlice("classic-elb-listener", nil, "Classic Load Balancer listener, as name:port, to point at the new IAM server certificate")
+	var keyType *string = pflag.String("key-type", acme.KeyTypeECDSA, "Certificate key type, ecdsa or rsa")
+	var replicaRegions *string = pflag.String("replica-regions", "", "Comma separated list of additional regions to import the certificate into ACM in, the certificates are not attached to any load balancer there")
+	var pkcs12PasswordFile *string = pflag.String("pkcs12-password-file", "", "Path of a file containing the PKCS#12 bundle password, the ACME_PKCS12_PASSWORD environment variable is used if not provided")
+	var dnsSolverName *string = pflag.String("dns-solver", "", "DNS-01 solver to use, route53, rfc2136 or cloudflare, challenges are solved over HTTP-01 on the ALB only if not provided")
+	var route53HostedZoneId *string = pflag.String("route53-hosted-zone-id", "", "ID of the Route53 hosted zone for the challenge records, found from the domain if not provided")
+	var route53Endpoint *string = pflag.String("route53-endpoint", "", "Route53 API endpoint, such as a local Route53 stand-in")
+	var dnsNameservers *[]string = pflag.StringSlice("dns-nameservers", nil, "Name servers, as host or host:port, to check the challenge records on, the authoritative name servers of the zone if not provided")
+	var dnsDelegationZone *string = pflag.String("dns-delegation-zone", "", "Zone of the dns-solver that _acme-challenge.<domain> is delegated to with a CNAME record to <domain>.<zone>")
+	var dnsResolvers *[]string = pflag.StringSlice("dns-resolvers", nil, "Resolvers, as host or host:port, to check the delegation CNAME records, the CAA records and the ALB addresses serving HTTP-01 challenges with, the system resolvers if not provided")
+	var rfc2136Server *string = pflag.String("rfc2136-server", "", "Name server, as host or host:port, to send RFC 2136 dynamic updates to")
+	var rfc2136Zone *string = pflag.String("rfc2136-zone", "", "Zone to update, found from the SOA record of the challenge name if not provided")
+	var rfc2136TSIGKey *string = pflag.String("rfc2136-tsig-key", "", "Name of the TSIG key to sign the updates with")
+	var rfc2136TSIGAlgorithm *string = pflag.String("rfc2136-tsig-algorithm", solver.DefaultTSIGAlgorithm, "TSIG algorithm, such as hmac-sha256. or hmac-sha512.")
+	var rfc2136TSIGSecretFile *string = pflag.String("rfc2136-tsig-secret-file", "", "Path of a file containing the base64 TSIG secret, the ACME_RFC2136_TSIG_SECRET environment variable is used if not provided")
+	var cloudflareTokenSSM *string = pflag.String("cloudflare-token-ssm", "", "Name of the AWS SSM parameter holding the Cloudflare API token")
+	var cloudflareTokenSecret *string = pflag.String("cloudflare-token-secret", "", "Name or ARN of the AWS Secrets Manager secret holding the Cloudflare API token")
+	var cloudflareZoneId *string = pflag.String("cloudflare-zone-id", "", "ID of the Cloudflare zone for the challenge records, found from the domain if not provided")
+	var cloudflareApiUrl *string = pflag.String("cloudflare-api-url", cloudflare.DefaultBaseURL, "Cloudflare API URL, such as a local stand-in of the API")
+	var standalone *[]string = pflag.StringSlice("standalone", nil, "Challenges to answer with listeners run by the CLI for the duration of the order, http-01 and/or tls-alpn-01")
+	var httpAddr *string = pflag.String("http-addr", solver.DefaultHttpAddr, "Address for the standalone HTTP-01 listener")
+	var tlsAlpnAddr *string = pflag.String("tls-alpn-addr", solver.DefaultTlsAlpnAddr, "Address for the standalone TLS-ALPN-01 listener")
+	var webroot *string = pflag.String("webroot", "", "Document root of a running web server to answer HTTP-01 challenges with files in .well-known/acme-challenge")
+	var challengeLambdaArn *string = pflag.String("challenge-lambda-arn", "", "ARN of the cloudacme lambda function to answer HTTP-01 challenges on the ALB with, instead of a rule per challenge")
+	var challengeSSM *string = pflag.String("challenge-ssm", solver.DefaultChallengeSSMPrefix, "SSM parameter prefix of the challenges answered by the lambda function, as ACME_CHALLENGE_SSM_PREFIX of the function")
+	var skipDnsCheck *bool = pflag.Bool("skip-dns-check", false, "Order without checking the domains point at the ALB, such as when a CDN in front of the ALB forwards the HTTP-01 challenge requests")
+	var skipIPv6Check *bool = pflag.Bool("skip-ipv6-check", false, "Check HTTP-01 challenges through the IPv4 addresses of the domains only, when this host has no IPv6 connectivity")
+	var skipCAACheck *bool = pflag.Bool("skip-caa-check", false, "Order without checking the CAA records of the domains permit the CA to issue")
+	var rulePriorityBand *string = pflag.String("rule-priority-band", "", "Range of listener rule priorities reserved for the ALB rules, such as 100-199, any free priority ahead of the rules that could shadow them if not provided")
 	pflag.Parse()
 
-	if *domain == "" {
+	files := export.Files{
+		CertPath:       *certFile,
+		ChainPath:      *chainFile,
+		FullchainPath:  *fullchainFile,
+		KeyPath:        *keyFile,
+		PKCS12Path:     *pkcs12File,
+		PKCS12Password: os.Getenv("ACME_PKCS12_PASSWORD"),
+	}
+	if *pkcs12PasswordFile != "" {
+		password, err := os.ReadFile(*pkcs12PasswordFile)
+		if err != nil {
+			log.Fatalf("failed to read pkcs12 password file: %v", err)
+		}
+		files.PKCS12Password = strings.TrimRight(string(password), "\r\n")
+	}
+
+	if len(*domains) == 0 {
 		log.Fatalf("domain is required")
 	}
+	domain := (*domains)[0]
+
+	importToAcm := *certArn != "" || *createIfMissing
+	regions := acme.ParseRegions(*replicaRegions)
+	if !importToAcm && *cloudFrontDistributionId == "" && *apiGatewayDomain == "" && len(regions) == 0 && *iamServerCertificateName == "" && files.Empty() {
+		log.Fatalf("cert-arn, cloudfront-distribution-id, apigateway-domain, replica-regions, iam-server-certificate-name or an output file is required")
+	}
+
+	var listeners []target.ClassicListener
+	for _, l := range *classicElbListeners {
+		listener, err := target.ParseClassicListener(l)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) > 0 && *iamServerCertificateName == "" {
+		log.Fatalf("iam-server-certificate-name is required for classic-elb-listener")
+	}
+
+	var dnsSolver acmez.Solver
+	switch *dnsSolverName {
+	case "":
+	case "route53":
+		dnsSolver = &solver.Route53Dns01Solver{
+			HostedZoneId: *route53HostedZoneId,
+			Endpoint:     *route53Endpoint,
+			Nameservers:  *dnsNameservers,
+		}
+	case "rfc2136":
+		if *rfc2136Server == "" {
+			log.Fatalf("rfc2136-server is required for the rfc2136 dns-solver")
+		}
+		secret := os.Getenv("ACME_RFC2136_TSIG_SECRET")
+		if *rfc2136TSIGSecretFile != "" {
+			data, err := os.ReadFile(*rfc2136TSIGSecretFile)
+			if err != nil {
+				log.Fatalf("failed to read tsig secret file: %v", err)
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if *rfc2136TSIGKey != "" && secret == "" {
+			log.Fatalf("rfc2136-tsig-secret-file or ACME_RFC2136_TSIG_SECRET is required for rfc2136-tsig-key")
+		}
+		dnsSolver = solver.RFC2136Dns01Solver{
+			Server:        *rfc2136Server,
+			Zone:          *rfc2136Zone,
+			TSIGKeyName:   *rfc2136TSIGKey,
+			TSIGSecret:    secret,
+			TSIGAlgorithm: *rfc2136TSIGAlgorithm,
+			Nameservers:   *dnsNameservers,
+		}
+	case "cloudflare":
+		token, err := loadSecret(context.Background(), *cloudflareTokenSSM, *cloudflareTokenSecret)
+		if err != nil {
+			log.Fatalf("failed to load cloudflare api token: %v", err)
+		}
+		dnsSolver = solver.CloudflareDns01Solver{
+			Client:      cloudflare.Client{Token: strings.TrimSpace(token), BaseURL: *cloudflareApiUrl},
+			ZoneId:      *cloudflareZoneId,
+			Nameservers: *dnsNameservers,
+		}
+	default:
+		log.Fatalf("unknown dns-solver %q", *dnsSolverName)
+	}
+	if *dnsDelegationZone != "" {
+		records, ok := dnsSolver.(solver.TXTRecords)
+		if !ok {
+			log.Fatalf("dns-solver is required for dns-delegation-zone")
+		}
+		dnsSolver = solver.DelegatedDns01Solver{
+			Records:        records,
+			ValidationZone: *dnsDelegationZone,
+			Resolvers:      *dnsResolvers,
+		}
+	}
+	var httpSolver, tlsAlpnSolver acmez.Solver
+	for _, challenge := range *standalone {
+		switch challenge {
+		case "http-01":
+			httpSolver = &solver.StandaloneHttp01Solver{Addr: *httpAddr}
+		case "tls-alpn-01":
+			tlsAlpnSolver = &solver.StandaloneTlsAlpn01Solver{Addr: *tlsAlpnAddr}
+		default:
+			log.Fatalf("unknown standalone challenge %q, expected http-01 or tls-alpn-01", challenge)
+		}
+	}
+
+	if *webroot != "" {
+		if httpSolver != nil {
+			log.Fatalf("webroot cannot be used with the standalone http-01 challenge")
+		}
+		httpSolver = solver.WebrootHttp01Solver{Root: *webroot, Resolvers: *dnsResolvers, SkipIPv6Check: *skipIPv6Check}
+	}
+
+	// The aliases of the distribution reach the ALB origin through CloudFront, they do not point at the ALB
+	var frontedDomains []string
+	if *cloudFrontDistributionId != "" && *albArn != "" {
+		dist, err := cloudfront.GetDistribution(context.Background(), *cloudFrontDistributionId)
+		if err != nil {
+			log.Fatalf("failed to get cloudfront distribution: %v", err)
+		}
+		frontedDomains = dist.Aliases
+	}
 
-	if *certArn == "" {
-		log.Fatalf("cert-arn is required")
+	if *challengeLambdaArn != "" {
+		if httpSolver != nil {
+			log.Fatalf("challenge-lambda-arn cannot be used with webroot or the standalone http-01 challenge")
+		}
+		if *albArn == "" {
+			log.Fatalf("alb-arn is required for challenge-lambda-arn")
+		}
+		httpSolver = solver.LambdaHttp01Solver{
+			AlbArn:         *albArn,
+			LambdaArn:      *challengeLambdaArn,
+			Store:          solver.SSMChallengeStore{Prefix: *challengeSSM},
+			Resolvers:      *dnsResolvers,
+			SkipDnsCheck:   *skipDnsCheck,
+			SkipIPv6Check:  *skipIPv6Check,
+			FrontedDomains: frontedDomains,
+		}
 	}
 
-	if *albArn == "" {
+	if *apiGatewayDomain != "" && dnsSolver == nil {
+		log.Fatalf("a DNS-01 solver is required for apigateway-domain")
+	}
+
+	if *cloudFrontDistributionId != "" && *albArn == "" && dnsSolver == nil {
+		// CloudFront cannot run the ALB HTTP-01 flow, the challenge is answered by the ALB behind the distribution
+		log.Fatalf("alb-arn of the distribution origin or a dns-solver is required for cloudfront-distribution-id")
+	}
+
+	if *createIfMissing && *albArn == "" {
 		log.Fatalf("alb-arn is required")
 	}
 
+	if files.PKCS12Path != "" && files.PKCS12Password == "" {
+		log.Fatalf("pkcs12-password-file or ACME_PKCS12_PASSWORD is required for the PKCS#12 bundle")
+	}
+
 	var logger *zap.Logger
 	var err error
 	if *debug {
@@ -46,7 +262,11 @@ func main() {
 		log.Fatalf("failed to create logger: %v", err)
 	}
 
-	ctx := context.Background()
+	band, err := alb.ParsePriorityBand(*rulePriorityBand)
+	if err != nil {
+		log.Fatalf("invalid rule-priority-band: %v", err)
+	}
+	ctx := alb.WithPriorityBand(context.Background(), band)
 
 	var keyStore acme.AccountKeyStore
 
@@ -58,20 +278,106 @@ func main() {
 
 	accountPrivateKey, err := acme.LoadOrCreateAccountKey(ctx, keyStore)
 
+	attached := true
+	if importToAcm && *certArn == "" {
+		*certArn, attached, err = acme.FindCertificateToUpdate(ctx, *albArn, domain, true)
+		if err != nil {
+			log.Fatalf("Failed to find certificate to update: %v", err)
+		}
+	}
+
 	acmeClient := acme.Acme{
-		Directory:  *acmeDirectory,
-		AccountKey: accountPrivateKey,
-		Logger:     logger,
-		AlbArn:     *albArn,
+		Directory:     *acmeDirectory,
+		AccountKey:    accountPrivateKey,
+		Logger:        logger,
+		AlbArn:        *albArn,
+		HttpSolver:    httpSolver,
+		DnsSolver:     dnsSolver,
+		TlsAlpnSolver: tlsAlpnSolver,
+		KeyType:       *keyType,
+		Resolvers:     *dnsResolvers,
+		SkipCAACheck:  *skipCAACheck,
+	}
+	// The ALB answers HTTP-01 unless other solvers are configured, the ALB might not serve HTTP for the domain
+	if *albArn != "" && dnsSolver == nil && httpSolver == nil && tlsAlpnSolver == nil {
+		acmeClient.HttpSolver = solver.AlbHttp01Solver{AlbArn: *albArn, Resolvers: *dnsResolvers, SkipDnsCheck: *skipDnsCheck, SkipIPv6Check: *skipIPv6Check, FrontedDomains: frontedDomains}
 	}
 
-	key, chain, err := acmeClient.GetCertificate(ctx, []string{*domain})
+	key, chain, err := acmeClient.GetCertificate(ctx, *domains)
 	if err != nil {
 		log.Fatalf("Failed to get certificates: %v", err)
 	}
 
-	if err := acm.ImportCertificate(ctx, key, chain, *certArn); err != nil {
-		log.Printf("Error importing certificate: %v", err)
+	// Every target is deployed to even when one fails, the run exits with an error status if any failed
+	failed := false
+	if !files.Empty() {
+		if err := files.Write(key, chain); err != nil {
+			log.Printf("Error writing certificate files: %v", err)
+			failed = true
+		}
+	}
+
+	var history acme.CertificateHistory
+	if *certHistorySSM != "" {
+		history = acme.SSMCertificateHistory{Prefix: *certHistorySSM, KmsKeyId: *certHistoryKmsKey}
+	}
+
+	if *cloudFrontDistributionId != "" {
+		cf := target.CloudFront{DistributionId: *cloudFrontDistributionId, History: history}
+		if _, err := cf.Deploy(ctx, domain, key, chain); err != nil {
+			log.Printf("Error deploying certificate to CloudFront: %v", err)
+			failed = true
+		}
+	}
+
+	if *apiGatewayDomain != "" {
+		apigw := target.ApiGateway{DomainName: *apiGatewayDomain, Version: *apiGatewayVersion, History: history}
+		if _, err := apigw.Deploy(ctx, key, chain); err != nil {
+			log.Printf("Error deploying certificate to API Gateway: %v", err)
+			failed = true
+		}
+	}
+
+	if *iamServerCertificateName != "" {
+		iamCert := target.IAMServerCertificate{Name: *iamServerCertificateName, Path: *iamPath, Listeners: listeners}
+		if _, err := iamCert.Deploy(ctx, key, chain); err != nil {
+			log.Printf("Error deploying IAM server certificate: %v", err)
+			failed = true
+		}
 	}
 
+	if len(regions) > 0 {
+		if _, err := acme.ReplicateCertificate(ctx, history, regions, domain, key, chain); err != nil {
+			log.Printf("Error replicating certificate: %v", err)
+			failed = true
+		}
+	}
+
+	if importToAcm {
+		newCertArn, err := acme.DeployCertificate(ctx, history, *albArn, domain, key, chain, *certArn, attached)
+		if err != nil {
+			log.Printf("Error importing certificate: %v", err)
+			failed = true
+		} else if newCertArn != *certArn {
+			log.Printf("Created certificate %v", newCertArn)
+		}
+	}
+
+	if failed {
+		log.Fatalf("The certificate was issued but not deployed to every target")
+	}
+}
+
+// loadSecret reads a secret from the SSM parameter or the Secrets Manager secret, whichever is given
+func loadSecret(ctx context.Context, ssmName, secretId string) (string, error) {
+	switch {
+	case ssmName != "" && secretId != "":
+		return "", errors.New("only one of the SSM parameter and the Secrets Manager secret can be given")
+	case ssmName != "":
+		return ssm.GetParameter(ctx, ssmName)
+	case secretId != "":
+		return secretsmanager.GetSecretString(ctx, secretId)
+	default:
+		return "", errors.New("an SSM parameter or a Secrets Manager secret is required")
+	}
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/spf13/pflag"
+)
+
+func rollback(args []string) {
+	flags := pflag.NewFlagSet("rollback", pflag.ExitOnError)
+	var certArn *string = flags.String("cert-arn", "", "ARN of the certificate to roll back")
+	var certHistorySSM *string = flags.String("cert-history-ssm", acme.DefaultCertificateHistoryPrefix, "SSM parameter prefix the certificate history is saved under")
+	flags.Parse(args)
+
+	if *certArn == "" {
+		log.Fatalf("cert-arn is required")
+	}
+
+	history := acme.SSMCertificateHistory{Prefix: *certHistorySSM}
+	if err := acme.RollbackCertificate(context.Background(), history, *certArn); err != nil {
+		log.Fatalf("Failed to roll back certificate: %v", err)
+	}
+	log.Printf("Rolled back certificate %v", *certArn)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/mholt/acmez"
 )
 
 const acmeLambdaPath = "/defang-acme-lambda"
@@ -26,48 +29,116 @@ const acmeLambdaPath = "/defang-acme-lambda"
 var version = "dev" // to be set by ldflags
 
 type CertificateRenewalEvent struct {
-	Domain string `json:"domain"`
-	AlbArn string `json:"albArn"`
+	Domain     string   `json:"domain"`
+	Domains    []string `json:"domains"` // additional names of a SAN certificate, the names of the existing certificate when empty
+	AlbArn     string   `json:"albArn"`
+	ForceRenew bool     `json:"forceRenew"`
+}
+
+// AllDomains returns Domain followed by Domains, the first domain identifies the certificate
+func (e CertificateRenewalEvent) AllDomains() []string {
+	var domains []string
+	for _, d := range append([]string{e.Domain}, e.Domains...) {
+		if d != "" && !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains
 }
 
 type Event struct {
 	events.ALBTargetGroupRequest
 	CertificateRenewalEvent
+	Action string `json:"action"`
 }
 
 func HandleEvent(ctx context.Context, evt Event) (any, error) {
 	log.Printf("cloudacme version %v", version)
+	band, err := alb.ParsePriorityBand(os.Getenv("ACME_RULE_PRIORITY_BAND"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACME_RULE_PRIORITY_BAND: %w", err)
+	}
+	ctx = alb.WithPriorityBand(ctx, band)
+
 	if evt.HTTPMethod != "" {
 		return HandleALBEvent(ctx, evt.ALBTargetGroupRequest)
-	} else {
-		_, cert, err := acme.GetExistingCertificate(ctx, evt.AlbArn, evt.Domain)
+	} else if evt.Action == "bootstrap" {
+		ownArn, err := ownFunctionArn(ctx)
 		if err != nil {
+			return nil, err
+		}
+		log.Printf("Bootstrapping domains %v on load balancer %s", evt.AllDomains(), evt.AlbArn)
+		return nil, acme.Bootstrap(ctx, evt.AlbArn, ownArn, evt.AllDomains())
+	} else if evt.Action == "gc" {
+		return nil, HandleGCEvent(ctx, evt.AlbArn)
+	} else {
+		domains := evt.AllDomains()
+		if len(domains) == 0 {
+			return nil, errors.New("domain is required")
+		}
+		evt.Domain = domains[0]
+
+		certArn, cert, err := acme.GetExistingCertificate(ctx, evt.AlbArn, evt.Domain)
+		if errors.Is(err, acme.ErrCertificateNotFound) && acme.CreateMissingCertificate() {
+			log.Printf("No certificate for domain %s attached to the load balancer, a new certificate will be created", evt.Domain)
+		} else if err != nil {
 			return nil, fmt.Errorf("failed to get existing certificate: %w", err)
 		}
 
-		ownArn := ""
-		if lc, ok := lambdacontext.FromContext(ctx); ok {
-			ownArn = lc.InvokedFunctionArn
+		ownArn, err := ownFunctionArn(ctx)
+		if err != nil {
+			return nil, err
 		}
-		if ownArn == "" {
-			return nil, errors.New("unable to determine own Lambda ARN from context")
+
+		origin := acme.OriginOther
+		if cert != nil {
+			if origin, err = acme.IssuerRecognizerFromEnv().Recognize(ctx, certArn, cert); err != nil {
+				return nil, fmt.Errorf("failed to recognize certificate issuer: %w", err)
+			}
 		}
 
-		if !IsLetsEncryptCertificate(cert) {
-			log.Printf("Certificate for domain %s is not issued by Let's Encrypt, initial run, setup load balancer rule for acme lambda", evt.Domain)
-			return nil, acme.SetupHttpRule(ctx, evt.AlbArn, ownArn, alb.RuleCondition{
-				HostHeader:  []string{evt.Domain},
-				PathPattern: []string{"/"},
-			})
+		if origin != acme.OriginIssued {
+			log.Printf("Certificate for domain %s is not issued by the ACME CA (%v), initial run, setup load balancer rules for acme lambda", evt.Domain, origin)
+			for _, domain := range domains {
+				if err := acme.SetupHttpRule(ctx, evt.AlbArn, ownArn, alb.RuleCondition{
+					HostHeader:  []string{domain},
+					PathPattern: []string{"/"},
+				}); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
 		} else {
+			threshold, err := acme.RenewalThresholdFromEnv()
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACME_RENEW_BEFORE: %w", err)
+			}
+			if !evt.ForceRenew && !threshold.ShouldRenew(cert, time.Now()) {
+				log.Printf("Certificate for domain %s expires %v, not due for renewal until %v", evt.Domain, cert.NotAfter, threshold.RenewAt(cert))
+				return nil, nil
+			}
+			if len(evt.Domains) == 0 {
+				evt.Domains = acme.CertificateDomains(evt.Domain, cert)[1:]
+			}
 			return nil, HandleScheduledRenewalEvent(ctx, evt.CertificateRenewalEvent)
 		}
 	}
 }
 
+func ownFunctionArn(ctx context.Context) (string, error) {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.InvokedFunctionArn != "" {
+		return lc.InvokedFunctionArn, nil
+	}
+	return "", errors.New("unable to determine own Lambda ARN from context")
+}
+
 func HandleALBEvent(ctx context.Context, evt events.ALBTargetGroupRequest) (*events.ALBTargetGroupResponse, error) {
 	log.Printf("Handling ALB Event: %+v", evt)
 
+	if strings.HasPrefix(evt.Path, solver.ChallengePathPrefix) {
+		return serveChallenge(ctx, evt)
+	}
+
 	targetGroupArn := evt.RequestContext.ELB.TargetGroupArn
 	albArn, err := alb.GetTargetGroupAlb(ctx, targetGroupArn)
 	if err != nil {
@@ -75,34 +146,43 @@ func HandleALBEvent(ctx context.Context, evt events.ALBTargetGroupRequest) (*eve
 	}
 
 	host := evt.Headers["host"]
-	albSolver := solver.AlbHttp01Solver{
-		AlbArn:  albArn,
-		Domains: []string{host},
+	domains, err := requestDomains(ctx, albArn, host)
+	if err != nil {
+		return nil, err
+	}
+
+	httpSolver, err := challengeSolver(ctx, albArn)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := acme.UpdateAcmeCertificate(ctx, albArn, host, albSolver); err != nil {
+	if _, err := acme.UpdateAcmeCertificate(ctx, albArn, domains, httpSolver); err != nil {
 		return nil, fmt.Errorf("failed to update certificate: %w", err)
 	}
 
-	if os.Getenv("ACME_HTTP_LISTENER_ARN") != "" {
-		// Pulumi-managed: modify the rule path so the default HTTP->HTTPS redirect takes over
-		if err := moveHttpRuleToAcmePath(ctx, albArn, host); err != nil {
-			return nil, fmt.Errorf("failed to move http rule: %w", err)
-		}
-	} else {
-		// Self-managed (old behavior): remove the rule entirely
-		cond := alb.RuleCondition{
-			HostHeader:  []string{host},
-			PathPattern: []string{"/"},
-		}
-		if err := acme.RemoveHttpRule(ctx, albArn, cond); err != nil {
-			return nil, fmt.Errorf("failed to remove http rule: %w", err)
+	for _, domain := range domains {
+		if os.Getenv("ACME_HTTP_LISTENER_ARN") != "" {
+			// Pulumi-managed: modify the rule path so the default HTTP->HTTPS redirect takes over
+			if err := moveHttpRuleToAcmePath(ctx, albArn, domain); err != nil {
+				return nil, fmt.Errorf("failed to move http rule: %w", err)
+			}
+		} else {
+			// Self-managed (old behavior): remove the rule entirely
+			cond := alb.RuleCondition{
+				HostHeader:  []string{domain},
+				PathPattern: []string{"/"},
+			}
+			if err := acme.RemoveHttpRule(ctx, albArn, cond); errors.Is(err, alb.ErrRuleNotFound) {
+				log.Printf("HTTP rule for / not found for %s, skipping removal", domain)
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to remove http rule: %w", err)
+			}
 		}
 	}
 
 	validationCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer cancel()
-	if err := validateCertAttached(validationCtx, host); err != nil {
+	if err := validateCertAttached(validationCtx, host, nil); err != nil {
 		return nil, fmt.Errorf("failed to validate certificate: %w", err)
 	}
 
@@ -114,12 +194,70 @@ func HandleALBEvent(ctx context.Context, evt events.ALBTargetGroupRequest) (*eve
 	}, nil
 }
 
-func validateCertAttached(ctx context.Context, domain string) error {
+// challengeSolver returns the HTTP-01 solver selected by ACME_HTTP01_SOLVER: alb, the default, answers each
+// challenge with a fixed response rule, lambda answers them from this function through a single rule.
+func challengeSolver(ctx context.Context, albArn string) (acmez.Solver, error) {
+	resolvers := acme.DnsResolversFromEnv()
+	skipDnsCheck := os.Getenv("ACME_SKIP_DNS_CHECK") == "true"
+	skipIPv6Check := os.Getenv("ACME_SKIP_IPV6_CHECK") == "true"
+	switch os.Getenv("ACME_HTTP01_SOLVER") {
+	case "", "alb":
+		return solver.AlbHttp01Solver{AlbArn: albArn, Resolvers: resolvers, SkipDnsCheck: skipDnsCheck, SkipIPv6Check: skipIPv6Check}, nil
+	case "lambda":
+		ownArn, err := ownFunctionArn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return solver.LambdaHttp01Solver{
+			AlbArn:        albArn,
+			LambdaArn:     ownArn,
+			Store:         challengeStore(),
+			Resolvers:     resolvers,
+			SkipDnsCheck:  skipDnsCheck,
+			SkipIPv6Check: skipIPv6Check,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ACME_HTTP01_SOLVER %q, expected alb or lambda", os.Getenv("ACME_HTTP01_SOLVER"))
+	}
+}
+
+func challengeStore() solver.ChallengeStore {
+	return solver.SSMChallengeStore{Prefix: os.Getenv("ACME_CHALLENGE_SSM_PREFIX")}
+}
+
+func serveChallenge(ctx context.Context, evt events.ALBTargetGroupRequest) (*events.ALBTargetGroupResponse, error) {
+	keyAuthorization, err := solver.ServeChallenge(ctx, challengeStore(), evt.Path)
+	if errors.Is(err, solver.ErrChallengeNotFound) {
+		log.Printf("No pending challenge for %v%v", evt.Headers["host"], evt.Path)
+		return &events.ALBTargetGroupResponse{StatusCode: 404, Headers: map[string]string{"Content-Type": "text/plain"}, Body: "not found"}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get challenge: %w", err)
+	}
+	log.Printf("Answering challenge for %v%v", evt.Headers["host"], evt.Path)
+	return &events.ALBTargetGroupResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       keyAuthorization,
+	}, nil
+}
+
+// errCertificateNotServed is returned by validateCertAttached when the domain kept serving a certificate that
+// fails verification, or not the expected one, until the validation timed out
+var errCertificateNotServed = errors.New("certificate not served")
+
+// validateCertAttached polls https://domain until the certificate it serves verifies, and is want when want is
+// not nil. A certificate problem lasting until ctx ends is returned wrapping errCertificateNotServed, other
+// failures, such as DNS or connection errors, are returned as they are.
+func validateCertAttached(ctx context.Context, domain string, want *x509.Certificate) error {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
+	var certErr error
 	for {
 		select {
 		case <-ctx.Done():
+			if certErr != nil {
+				return fmt.Errorf("%w: %w", errCertificateNotServed, certErr)
+			}
 			return ctx.Err()
 		case <-ticker.C:
 			req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s", domain), nil)
@@ -127,14 +265,25 @@ func validateCertAttached(ctx context.Context, domain string) error {
 				return fmt.Errorf("failed to create request: %w", err)
 			}
 
-			if _, err := http.DefaultClient.Do(req); err != nil {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
 				var tlsErr *tls.CertificateVerificationError
 				if errors.As(err, &tlsErr) {
 					log.Printf("ssl cert for %v is still not valid: %v", domain, tlsErr)
+					certErr = tlsErr
+					continue
+				}
+				if ctx.Err() != nil {
 					continue
 				}
 				return fmt.Errorf("failed https request to domain %v: %w", domain, err)
 			}
+			resp.Body.Close()
+			if want != nil && (resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 || !bytes.Equal(resp.TLS.PeerCertificates[0].Raw, want.Raw)) {
+				certErr = fmt.Errorf("%v does not serve the certificate with serial %v", domain, want.SerialNumber)
+				log.Printf("ssl cert for %v is not the renewed one yet", domain)
+				continue
+			}
 			return nil
 		}
 	}
@@ -174,35 +323,82 @@ func moveHttpRuleToAcmePath(ctx context.Context, albArn, host string) error {
 	return nil
 }
 
+// requestDomains returns the domains to issue the certificate for from a request to host: the names of the
+// placeholder or previously issued certificate for host, so that SAN certificates keep all their names.
+func requestDomains(ctx context.Context, albArn, host string) ([]string, error) {
+	certArn, cert, err := acme.GetExistingCertificate(ctx, albArn, host)
+	if errors.Is(err, acme.ErrCertificateNotFound) {
+		return []string{host}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get existing certificate: %w", err)
+	}
+
+	origin, err := acme.IssuerRecognizerFromEnv().Recognize(ctx, certArn, cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recognize certificate issuer: %w", err)
+	}
+	if origin == acme.OriginOther {
+		return []string{host}, nil
+	}
+	return acme.CertificateDomains(host, cert), nil
+}
+
 func HandleScheduledRenewalEvent(ctx context.Context, evt CertificateRenewalEvent) error {
 	log.Printf("Handling Certificate Renewal Event: %+v", evt)
 
-	albSolver := solver.AlbHttp01Solver{
-		AlbArn:  evt.AlbArn,
-		Domains: []string{evt.Domain},
+	httpSolver, err := challengeSolver(ctx, evt.AlbArn)
+	if err != nil {
+		return err
 	}
 
-	if err := acme.UpdateAcmeCertificate(ctx, evt.AlbArn, evt.Domain, albSolver); err != nil {
+	certArn, err := acme.UpdateAcmeCertificate(ctx, evt.AlbArn, evt.AllDomains(), httpSolver)
+	if err != nil {
 		return fmt.Errorf("failed to renew certificate: %w", err)
 	}
 
+	want, err := acme.GetAcmCertificate(ctx, certArn)
+	if err != nil {
+		log.Printf("Cannot get renewed certificate %v, only checking the served certificate verifies: %v", certArn, err)
+	}
+	validationCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	err = validateCertAttached(validationCtx, evt.Domain, want)
+	if err != nil && !errors.Is(err, errCertificateNotServed) {
+		// A network problem does not tell the certificate is bad, keep it
+		return fmt.Errorf("failed to validate renewed certificate, not rolled back: %w", err)
+	} else if err != nil {
+		history := acme.CertificateHistoryFromEnv()
+		if history == nil {
+			return fmt.Errorf("failed to validate renewed certificate, certificate history not enabled for rollback: %w", err)
+		}
+		log.Printf("Renewed certificate for %v failed validation, rolling back: %v", evt.Domain, err)
+		// The validation may have used most of the time left to the invocation, the rollback gets its own
+		rbCtx, rbCancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Minute)
+		defer rbCancel()
+		if rbErr := acme.RollbackCertificate(rbCtx, history, certArn); rbErr != nil {
+			return fmt.Errorf("failed to validate renewed certificate: %w, rollback failed: %w", err, rbErr)
+		}
+		return fmt.Errorf("failed to validate renewed certificate, rolled back: %w", err)
+	}
+
 	return nil
 }
 
-func IsLetsEncryptCertificate(cert *x509.Certificate) bool {
-	// Check Issuer Organization
-	for _, org := range cert.Issuer.Organization {
-		if strings.Contains(strings.ToLower(org), "let's encrypt") {
-			return true
-		}
+// HandleGCEvent deletes the challenge and trigger rules left on the load balancer by interrupted runs
+func HandleGCEvent(ctx context.Context, albArn string) error {
+	if albArn == "" {
+		return errors.New("albArn is required")
 	}
-
-	// Fallback: check Common Name
-	if strings.Contains(strings.ToLower(cert.Issuer.CommonName), "let's encrypt") {
-		return true
+	collector, err := acme.RuleCollectorFromEnv()
+	if err != nil {
+		return err
 	}
-
-	return false
+	stale, err := collector.Collect(ctx, albArn)
+	if err != nil {
+		return fmt.Errorf("failed to collect stale rules: %w", err)
+	}
+	log.Printf("Collected %d stale rules on load balancer %s", len(stale), albArn)
+	return nil
 }
 
 func main() {
@@ -0,0 +1,132 @@
+package export
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	certFileMode = 0644
+	keyFileMode  = 0600
+)
+
+// Files are the local files an issued certificate is written to, empty paths are skipped.
+type Files struct {
+	CertPath       string // leaf certificate
+	ChainPath      string // intermediate certificates
+	FullchainPath  string // leaf followed by the intermediates
+	KeyPath        string
+	PKCS12Path     string
+	PKCS12Password string
+}
+
+func (f Files) Empty() bool {
+	return f.CertPath == "" && f.ChainPath == "" && f.FullchainPath == "" && f.KeyPath == "" && f.PKCS12Path == ""
+}
+
+// Write writes the key and PEM certificate chain to the configured files. Each file is replaced atomically,
+// private keys and PKCS#12 bundles are only readable by the owner.
+func (f Files) Write(key crypto.Signer, chainPem []byte) error {
+	var certs []*x509.Certificate
+	for rest := chainPem; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate chain: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no certificate in chain")
+	}
+
+	if f.CertPath != "" {
+		if err := WriteFileAtomic(f.CertPath, encodeCerts(certs[:1]), certFileMode); err != nil {
+			return err
+		}
+	}
+	if f.ChainPath != "" {
+		if err := WriteFileAtomic(f.ChainPath, encodeCerts(certs[1:]), certFileMode); err != nil {
+			return err
+		}
+	}
+	if f.FullchainPath != "" {
+		if err := WriteFileAtomic(f.FullchainPath, encodeCerts(certs), certFileMode); err != nil {
+			return err
+		}
+	}
+	if f.KeyPath != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to marshal private key: %w", err)
+		}
+		if err := WriteFileAtomic(f.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), keyFileMode); err != nil {
+			return err
+		}
+	}
+	if f.PKCS12Path != "" {
+		if f.PKCS12Password == "" {
+			return errors.New("a password is required for the PKCS#12 bundle")
+		}
+		pfx, err := pkcs12.Modern.Encode(key, certs[0], certs[1:], f.PKCS12Password)
+		if err != nil {
+			return fmt.Errorf("failed to encode PKCS#12 bundle: %w", err)
+		}
+		if err := WriteFileAtomic(f.PKCS12Path, pfx, keyFileMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory and renames it over path,
+// so readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %v: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of %v: %w", path, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %v: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %v: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %v: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %v: %w", path, err)
+	}
+	return nil
+}
+
+func encodeCerts(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, cert := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return out
+}
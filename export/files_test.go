@@ -0,0 +1,174 @@
+package export
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testChain returns a leaf key and the PEM chain of the leaf and its issuer
+func testChain(t *testing.T) (crypto.Signer, *x509.Certificate, *x509.Certificate, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDer)
+	return key, leaf, ca, encodeCerts([]*x509.Certificate{leaf, ca})
+}
+
+func readFile(t *testing.T, path string, mode os.FileMode) []byte {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("mode of %v = %v, want %v", filepath.Base(path), info.Mode().Perm(), mode)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFilesWrite(t *testing.T) {
+	dir := t.TempDir()
+	key, leaf, ca, chain := testChain(t)
+	f := Files{
+		CertPath:       filepath.Join(dir, "cert.pem"),
+		ChainPath:      filepath.Join(dir, "chain.pem"),
+		FullchainPath:  filepath.Join(dir, "fullchain.pem"),
+		KeyPath:        filepath.Join(dir, "key.pem"),
+		PKCS12Path:     filepath.Join(dir, "cert.p12"),
+		PKCS12Password: "secret",
+	}
+	// a key file left readable by everyone is replaced by one only readable by the owner
+	if err := os.WriteFile(f.KeyPath, []byte("old key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Write(key, chain); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if got := readFile(t, f.CertPath, 0644); !bytes.Equal(got, encodeCerts([]*x509.Certificate{leaf})) {
+		t.Errorf("cert file = %s, want the leaf", got)
+	}
+	if got := readFile(t, f.ChainPath, 0644); !bytes.Equal(got, encodeCerts([]*x509.Certificate{ca})) {
+		t.Errorf("chain file = %s, want the issuer", got)
+	}
+	if got := readFile(t, f.FullchainPath, 0644); !bytes.Equal(got, chain) {
+		t.Errorf("fullchain file = %s, want the leaf and the issuer", got)
+	}
+
+	block, _ := pem.Decode(readFile(t, f.KeyPath, 0600))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("key file = %v, want a PKCS#8 private key", block)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*ecdsa.PrivateKey).Equal(parsed) {
+		t.Error("key file holds another key")
+	}
+
+	p12Key, p12Leaf, p12CAs, err := pkcs12.DecodeChain(readFile(t, f.PKCS12Path, 0600), "secret")
+	if err != nil {
+		t.Fatalf("PKCS#12 bundle: %v", err)
+	}
+	if !key.(*ecdsa.PrivateKey).Equal(p12Key) || !p12Leaf.Equal(leaf) || len(p12CAs) != 1 || !p12CAs[0].Equal(ca) {
+		t.Error("PKCS#12 bundle does not hold the key, the leaf and the issuer")
+	}
+
+	// no temporary file is left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 5 {
+		t.Errorf("files = %v, want the 5 configured files only", entries)
+	}
+}
+
+func TestFilesWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	key, _, _, chain := testChain(t)
+
+	if err := (Files{CertPath: filepath.Join(dir, "cert.pem")}).Write(key, []byte("not pem")); err == nil {
+		t.Error("Write() succeeded without a certificate in the chain")
+	}
+	if err := (Files{PKCS12Path: filepath.Join(dir, "cert.p12")}).Write(key, chain); err == nil {
+		t.Error("Write() succeeded without a PKCS#12 password")
+	}
+	if err := (Files{CertPath: filepath.Join(dir, "missing", "cert.pem")}).Write(key, chain); err == nil {
+		t.Error("Write() succeeded in a missing directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files = %v, want none written", entries)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a reader of the old file keeps reading it whole while the file is replaced
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	if got, _ := io.ReadAll(reader); string(got) != "old" {
+		t.Errorf("open file = %q, want the old contents", got)
+	}
+	if got := readFile(t, path, 0600); string(got) != "new" {
+		t.Errorf("file = %q, want the new contents", got)
+	}
+}
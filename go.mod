@@ -7,12 +7,22 @@ require (
 	github.com/aws/aws-sdk-go-v2 v1.25.3
 	github.com/aws/aws-sdk-go-v2/config v1.27.7
 	github.com/aws/aws-sdk-go-v2/service/acm v1.25.2
+	github.com/aws/aws-sdk-go-v2/service/apigateway v1.23.4
+	github.com/aws/aws-sdk-go-v2/service/apigatewayv2 v1.20.1
+	github.com/aws/aws-sdk-go-v2/service/cloudfront v1.35.0
+	github.com/aws/aws-sdk-go-v2/service/ec2 v1.150.0
+	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancing v1.24.1
 	github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2 v1.30.2
+	github.com/aws/aws-sdk-go-v2/service/iam v1.31.2
+	github.com/aws/aws-sdk-go-v2/service/route53 v1.40.2
+	github.com/aws/aws-sdk-go-v2/service/secretsmanager v1.28.3
 	github.com/aws/aws-sdk-go-v2/service/ssm v1.49.3
 	github.com/aws/smithy-go v1.20.1
 	github.com/mholt/acmez v1.2.0
+	github.com/miekg/dns v1.1.62
 	github.com/spf13/pflag v1.0.5
 	go.uber.org/zap v1.24.0
+	software.sslmate.com/src/go-pkcs12 v0.7.2
 )
 
 require (
@@ -30,6 +40,10 @@ require (
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/crypto v0.45.0 // indirect
+	golang.org/x/mod v0.29.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
+	golang.org/x/sync v0.18.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
+	golang.org/x/tools v0.38.0 // indirect
 )
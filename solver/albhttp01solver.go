@@ -4,9 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"time"
 
 	"github.com/DefangLabs/cloudacme/aws/alb"
@@ -16,21 +14,41 @@ import (
 
 const DefaultWaitTimeout = 5 * time.Minute
 
+// AlbHttp01Solver answers HTTP-01 challenges with a fixed response rule on the HTTP listener of the ALB.
+// Each challenge gets its own rule for its domain, so that SAN orders with any number of domains stay
+// within the limit of five condition values per rule.
 type AlbHttp01Solver struct {
 	AlbArn      string
-	Domains     []string
+	Resolvers   []string // resolvers to look up the load balancer nodes with, the system resolvers when empty
 	WaitTimeout time.Duration
+	// SkipDnsCheck places the order without checking the domains point at the ALB, such as when a CDN
+	// in front of the ALB forwards the challenge requests
+	SkipDnsCheck bool
+	// SkipIPv6Check checks the challenge through the IPv4 addresses only, when the host running the check
+	// has no IPv6 connectivity
+	SkipIPv6Check bool
+	// FrontedDomains are served through a CDN in front of the ALB, such as the aliases of a CloudFront
+	// distribution with the ALB as origin, and are not checked to point at the ALB
+	FrontedDomains []string
+}
+
+// Preflight checks that every domain points at the ALB, so that the challenge requests reach the rules
+func (s AlbHttp01Solver) Preflight(ctx context.Context, domains []string) error {
+	if s.SkipDnsCheck {
+		return nil
+	}
+	return checkPointsAtAlb(ctx, s.AlbArn, domains, s.FrontedDomains, s.Resolvers)
 }
 
 func (s AlbHttp01Solver) Present(ctx context.Context, chal acme.Challenge) error {
-	log.Printf("Presenting challenge for domain %v at path %v", s.Domains, chal.HTTP01ResourcePath())
+	log.Printf("Presenting challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
 	listener, err := alb.GetListener(ctx, s.AlbArn, awsalb.ProtocolEnumHttp, 80)
 	if err != nil {
 		return fmt.Errorf("cannot get http listener: %w", err)
 	}
 
 	ruleCond := alb.RuleCondition{
-		HostHeader:  s.Domains,
+		HostHeader:  []string{chal.Identifier.Value},
 		PathPattern: []string{chal.HTTP01ResourcePath()},
 	}
 
@@ -41,14 +59,14 @@ func (s AlbHttp01Solver) Present(ctx context.Context, chal acme.Challenge) error
 }
 
 func (s AlbHttp01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
-	log.Printf("Cleaning up challenge for domains %v at path %v", s.Domains, chal.HTTP01ResourcePath())
+	log.Printf("Cleaning up challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
 	listener, err := alb.GetListener(ctx, s.AlbArn, awsalb.ProtocolEnumHttp, 80)
 	if err != nil {
 		return fmt.Errorf("cannot get http listener: %w", err)
 	}
 
 	ruleCond := alb.RuleCondition{
-		HostHeader:  s.Domains,
+		HostHeader:  []string{chal.Identifier.Value},
 		PathPattern: []string{chal.HTTP01ResourcePath()},
 	}
 
@@ -62,55 +80,13 @@ func (s AlbHttp01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error
 }
 
 func (s AlbHttp01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
-	log.Printf("Waiting for challenge for domains %v at path %v", s.Domains, chal.HTTP01ResourcePath())
-	timeout := s.WaitTimeout
-	if timeout == 0 {
-		timeout = DefaultWaitTimeout
-	}
-
-	chkCtx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timeout waiting for challenge after %v", timeout))
+	log.Printf("Waiting for challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
 	defer cancel()
-	for _, domain := range s.Domains {
-		chkUrl := "http://" + domain + chal.HTTP01ResourcePath()
-		log.Printf("Checking URL %v", chkUrl)
-		if err := checkUrl(chkCtx, chkUrl, chal.KeyAuthorization); err != nil {
-			return fmt.Errorf("failed waiting for challenge: %w", err)
-		}
-	}
-	log.Printf("Challenge is ready for domains %v, at path %v", s.Domains, chal.HTTP01ResourcePath())
-	return nil
-}
-
-func checkUrl(ctx context.Context, url, value string) error {
-	// go http client defaults to follow 10 redirects which matches let's encrypt's limit
-	client := &http.Client{}
 
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-			if err != nil {
-				return fmt.Errorf("failed to create request: %w", err)
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				// ignore errors, like expected tls handshake errors
-				continue
-			}
-			if resp.StatusCode == 200 {
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					continue
-				}
-				if string(body) == value {
-					return nil
-				}
-			}
-		}
+	if err := checkAlbNodes(chkCtx, s.AlbArn, chal, s.Resolvers, s.SkipIPv6Check); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
 	}
+	log.Printf("Challenge is ready for domain %v, at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	return nil
 }
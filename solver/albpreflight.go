@@ -0,0 +1,148 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+)
+
+// maxCNAMEChain bounds the CNAME records followed from a domain
+const maxCNAMEChain = 8
+
+// checkPointsAtAlb checks that every domain is a CNAME to the DNS name of the load balancer, or resolves to
+// some of its addresses, as an alias record does. Ordering for a domain that does not reach the load balancer
+// fails validation, which counts against the failed validation limit of the CA. Domains served through a CDN
+// in front of the load balancer, matching one of fronted, are not checked.
+func checkPointsAtAlb(ctx context.Context, albArn string, domains, fronted []string, resolvers []string) error {
+	domains = slices.DeleteFunc(slices.Clone(domains), func(domain string) bool {
+		if matchesAnyName(domain, fronted) {
+			log.Printf("Domain %v is served through the CDN in front of the load balancer, not checking it points at it", domain)
+			return true
+		}
+		return false
+	})
+	if len(domains) == 0 {
+		return nil
+	}
+
+	lb, err := alb.GetLoadBalancer(ctx, albArn)
+	if err != nil {
+		return fmt.Errorf("cannot get load balancer %v: %w", albArn, err)
+	}
+	albName := strings.TrimSuffix(strings.ToLower(*lb.DNSName), ".")
+	albAddrs, err := lookupAddrs(ctx, albName, resolvers)
+	if err != nil {
+		return fmt.Errorf("cannot resolve load balancer %v: %w", albName, err)
+	}
+
+	var problems []string
+	for _, domain := range domains {
+		if problem := checkDomainPointsAt(ctx, domain, albName, albAddrs, resolvers); problem != "" {
+			problems = append(problems, "  "+problem)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("domains do not point at the load balancer " + albName + ", add a CNAME record to it or an alias record for it:\n" + strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// checkDomainPointsAt returns why the domain does not reach the load balancer, or an empty string when it does
+func checkDomainPointsAt(ctx context.Context, domain, albName string, albAddrs []netip.Addr, resolvers []string) string {
+	chain, err := cnameChain(ctx, domain, resolvers)
+	if err != nil {
+		return fmt.Sprintf("%v: %v", domain, err)
+	}
+	for _, name := range chain {
+		if isAlbName(name, albName) {
+			log.Printf("Domain %v is a CNAME to the load balancer %v", domain, albName)
+			return ""
+		}
+	}
+
+	via := ""
+	if len(chain) > 0 {
+		via = " through CNAME " + strings.Join(chain, " -> ")
+	}
+	addrs, err := lookupAddrs(ctx, domain, resolvers)
+	if err != nil {
+		return fmt.Sprintf("%v%v cannot be resolved: %v", domain, via, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Sprintf("%v%v has no A or AAAA records", domain, via)
+	}
+	// Each lookup of the load balancer returns a changing subset of its nodes, an alias record resolves to
+	// another subset than the lookup of the load balancer, so only some address has to be shared
+	if !slices.ContainsFunc(addrs, func(addr netip.Addr) bool { return slices.Contains(albAddrs, addr) }) {
+		return fmt.Sprintf("%v%v resolves to %v, which are not addresses of the load balancer (%v)", domain, via, joinAddrs(addrs), joinAddrs(albAddrs))
+	}
+	log.Printf("Domain %v resolves to addresses of the load balancer %v", domain, albName)
+	return ""
+}
+
+// cnameChain returns the targets of the CNAME records followed from name, empty when name has none
+func cnameChain(ctx context.Context, name string, resolvers []string) ([]string, error) {
+	if len(resolvers) == 0 {
+		// the system resolver only returns the canonical name at the end of the chain
+		target, err := net.DefaultResolver.LookupCNAME(ctx, name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if target = strings.TrimSuffix(target, "."); strings.EqualFold(target, strings.TrimSuffix(name, ".")) {
+			return nil, nil
+		}
+		return []string{target}, nil
+	}
+
+	var chain []string
+	for next := name; len(chain) < maxCNAMEChain; {
+		target, err := lookupCNAME(ctx, next, resolvers)
+		if err != nil || target == "" {
+			return chain, err
+		}
+		next = strings.TrimSuffix(target, ".")
+		chain = append(chain, next)
+	}
+	return chain, fmt.Errorf("more than %d CNAME records from %v", maxCNAMEChain, name)
+}
+
+// isAlbName reports whether name is the DNS name of the load balancer, also with the dualstack. prefix
+func isAlbName(name, albName string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return name == albName || strings.TrimPrefix(name, "dualstack.") == strings.TrimPrefix(albName, "dualstack.")
+}
+
+// matchesAnyName reports whether domain is one of names, or matches one of the wildcard names of one label
+func matchesAnyName(domain string, names []string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if name == domain {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			if label, rest, found := strings.Cut(domain, "."); found && label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", ")
+}
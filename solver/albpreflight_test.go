@@ -0,0 +1,94 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// aliasServer answers A queries of each name with its addresses, as alias records of the load balancer do
+func aliasServer(t *testing.T, addrs map[string][]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			for _, addr := range addrs[strings.TrimSuffix(q.Name, ".")] {
+				m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(addr)})
+			}
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestCheckDomainPointsAt(t *testing.T) {
+	const albName = "alb-123.us-east-1.elb.amazonaws.com"
+	resolvers := []string{aliasServer(t, map[string][]string{
+		"all.example.com":     {"10.0.0.1", "10.0.0.2"},
+		"rotated.example.com": {"10.0.0.2", "10.0.0.3"},
+		"other.example.com":   {"192.0.2.1"},
+	})}
+	// the lookup of the load balancer returned another subset of its nodes than the alias records
+	albAddrs := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")}
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"all.example.com", ""},
+		{"rotated.example.com", ""},
+		{"other.example.com", "resolves to 192.0.2.1, which are not addresses of the load balancer"},
+		{"missing.example.com", "has no A or AAAA records"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got := checkDomainPointsAt(context.Background(), tt.domain, albName, albAddrs, resolvers)
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("checkDomainPointsAt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPointsAtAlbFronted(t *testing.T) {
+	// the load balancer is not looked up when every domain is served through the CDN
+	fronted := []string{"www.example.com", "*.example.org"}
+	if err := checkPointsAtAlb(context.Background(), "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/test/1", []string{"WWW.example.com", "api.example.org"}, fronted, nil); err != nil {
+		t.Errorf("checkPointsAtAlb() error = %v", err)
+	}
+}
+
+func TestMatchesAnyName(t *testing.T) {
+	names := []string{"www.example.com", "*.example.org."}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"www.example.com", true},
+		{"WWW.Example.com.", true},
+		{"example.com", false},
+		{"api.example.org", true},
+		{"example.org", false},
+		{"a.b.example.org", false},
+	}
+	for _, tt := range tests {
+		if got := matchesAnyName(tt.domain, names); got != tt.want {
+			t.Errorf("matchesAnyName(%v) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/cloudflare"
+	"github.com/mholt/acmez/acme"
+)
+
+// CloudflareDns01Solver solves DNS-01 challenges with TXT records created through the Cloudflare API
+type CloudflareDns01Solver struct {
+	Client      cloudflare.Client
+	ZoneId      string   // found from the domain when empty
+	Nameservers []string // checked for propagation, as host or host:port, the name servers of the zone when empty
+	TTL         int
+	WaitTimeout time.Duration
+}
+
+func (s CloudflareDns01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.AddTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s CloudflareDns01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.RemoveTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s CloudflareDns01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Waiting for challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+	if err := s.WaitTXT(chkCtx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization()); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+// AddTXT creates a TXT record with the value, unless one exists already. Cloudflare keeps each value of
+// a name as a separate record.
+func (s CloudflareDns01Solver) AddTXT(ctx context.Context, name, value string) error {
+	zone, err := s.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	records, err := s.Client.ListTXTRecords(ctx, zone.Id, name)
+	if err != nil {
+		return fmt.Errorf("failed to list TXT records %v: %w", name, err)
+	}
+	for _, r := range records {
+		if txtContent(r.Content) == value {
+			return nil
+		}
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultDnsTTL
+	}
+	if _, err := s.Client.CreateDNSRecord(ctx, zone.Id, cloudflare.DNSRecord{
+		Type:    "TXT",
+		Name:    strings.TrimSuffix(name, "."),
+		Content: strconv.Quote(value),
+		TTL:     ttl,
+		Comment: "cloudacme DNS-01 challenge",
+	}); err != nil {
+		return fmt.Errorf("failed to add TXT record %v: %w", name, err)
+	}
+	return nil
+}
+
+func (s CloudflareDns01Solver) RemoveTXT(ctx context.Context, name, value string) error {
+	zone, err := s.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	records, err := s.Client.ListTXTRecords(ctx, zone.Id, name)
+	if err != nil {
+		return fmt.Errorf("failed to list TXT records %v: %w", name, err)
+	}
+	for _, r := range records {
+		if txtContent(r.Content) != value {
+			continue
+		}
+		if err := s.Client.DeleteDNSRecord(ctx, zone.Id, r.Id); err != nil {
+			return fmt.Errorf("failed to remove TXT record %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s CloudflareDns01Solver) WaitTXT(ctx context.Context, name, value string) error {
+	nameservers := s.Nameservers
+	if len(nameservers) == 0 {
+		zone, err := s.zone(ctx, name)
+		if err != nil {
+			return err
+		}
+		nameservers = zone.NameServers
+	}
+	return waitForTXT(ctx, name, value, nameservers)
+}
+
+func (s CloudflareDns01Solver) zone(ctx context.Context, name string) (*cloudflare.Zone, error) {
+	if s.ZoneId != "" {
+		return s.Client.GetZone(ctx, s.ZoneId)
+	}
+	zone, err := s.Client.FindZone(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find zone of %v: %w", name, err)
+	}
+	return zone, nil
+}
+
+// txtContent returns the value of the content of a TXT record, which Cloudflare keeps quoted or not as it was created
+func txtContent(content string) string {
+	if unquoted, err := strconv.Unquote(content); err == nil {
+		return unquoted
+	}
+	return content
+}
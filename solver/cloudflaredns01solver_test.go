@@ -0,0 +1,229 @@
+package solver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/cloudflare"
+	"github.com/mholt/acmez/acme"
+)
+
+// fakeCloudflare is a stand-in of the Cloudflare API with a single zone, publishing its TXT records on ns
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	zone    cloudflare.Zone
+	records []cloudflare.DNSRecord
+	nextId  int
+	fail    string // request method and path answered with an error
+	ns      *txtServer
+}
+
+func newFakeCloudflare(t *testing.T, zoneName string) (*fakeCloudflare, cloudflare.Client) {
+	t.Helper()
+	ns := newTXTServer(t)
+	api := &fakeCloudflare{zone: cloudflare.Zone{Id: "zone1", Name: zoneName, NameServers: []string{ns.Addr}}, ns: ns}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, cloudflare.Client{Token: "token", BaseURL: srv.URL, HTTPClient: srv.Client()}
+}
+
+func (api *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	write := func(result any) {
+		data, _ := json.Marshal(result)
+		fmt.Fprintf(w, `{"success":true,"errors":[],"result":%s,"result_info":{"page":1,"total_pages":1}}`, data)
+	}
+	if api.fail != "" && api.fail == r.Method+" "+r.URL.Path {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":1004,"message":"DNS Validation Error"}],"result":null}`)
+		return
+	}
+
+	recordsPath := "/zones/" + api.zone.Id + "/dns_records"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/zones":
+		zones := []cloudflare.Zone{}
+		if r.URL.Query().Get("name") == api.zone.Name {
+			zones = append(zones, api.zone)
+		}
+		write(zones)
+	case r.Method == http.MethodGet && r.URL.Path == "/zones/"+api.zone.Id:
+		write(api.zone)
+	case r.Method == http.MethodGet && r.URL.Path == recordsPath:
+		records := []cloudflare.DNSRecord{}
+		for _, rec := range api.records {
+			if rec.Name == r.URL.Query().Get("name") {
+				records = append(records, rec)
+			}
+		}
+		write(records)
+	case r.Method == http.MethodPost && r.URL.Path == recordsPath:
+		var rec cloudflare.DNSRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		api.nextId++
+		rec.Id = strconv.Itoa(api.nextId)
+		api.records = append(api.records, rec)
+		api.publish(rec.Name)
+		write(rec)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, recordsPath+"/"):
+		id := strings.TrimPrefix(r.URL.Path, recordsPath+"/")
+		for i, rec := range api.records {
+			if rec.Id == id {
+				api.records = append(api.records[:i], api.records[i+1:]...)
+				api.publish(rec.Name)
+				write(map[string]string{"id": id})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}],"result":null}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":7000,"message":"No route for that URI"}],"result":null}`)
+	}
+}
+
+// publish sets the TXT values of name on the name server from the records
+func (api *fakeCloudflare) publish(name string) {
+	var values []string
+	for _, rec := range api.records {
+		if rec.Name == name {
+			values = append(values, txtContent(rec.Content))
+		}
+	}
+	api.ns.Set(name, values...)
+}
+
+func (api *fakeCloudflare) contents(name string) []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	var contents []string
+	for _, rec := range api.records {
+		if rec.Name == name {
+			contents = append(contents, rec.Content)
+		}
+	}
+	return contents
+}
+
+func dnsChallenge(domain, keyAuth string) acme.Challenge {
+	return acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: domain},
+		KeyAuthorization: keyAuth,
+	}
+}
+
+func TestCloudflareDns01Solver(t *testing.T) {
+	api, client := newFakeCloudflare(t, "example.com")
+	s := CloudflareDns01Solver{Client: client, TTL: 120, WaitTimeout: 5 * time.Second}
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+	// the authorization of a wildcard names the base domain
+	wildcard := dnsChallenge("example.com", "token2.thumbprint")
+	const name = "_acme-challenge.www.example.com"
+
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	// presenting again keeps a single record
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if got := api.contents(name); len(got) != 1 || got[0] != strconv.Quote(chal.DNS01KeyAuthorization()) {
+		t.Fatalf("records = %v, want the quoted key authorization", got)
+	}
+	if api.records[0].TTL != 120 {
+		t.Errorf("TTL = %v, want 120", api.records[0].TTL)
+	}
+	if err := s.Present(ctx, dnsChallenge("www.example.com", "other.thumbprint")); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if err := s.Present(ctx, wildcard); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+
+	// the name servers of the zone are checked for the value
+	if err := s.Wait(ctx, chal); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := api.contents(name); len(got) != 1 || got[0] != strconv.Quote(dnsChallenge("", "other.thumbprint").DNS01KeyAuthorization()) {
+		t.Errorf("records after CleanUp() = %v, want the other value kept", got)
+	}
+	if got := api.contents("_acme-challenge.example.com"); len(got) != 1 {
+		t.Errorf("records of the wildcard after CleanUp() = %v", got)
+	}
+	// cleaning up again finds nothing to delete
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+}
+
+func TestCloudflareDns01SolverUnquoted(t *testing.T) {
+	api, client := newFakeCloudflare(t, "example.com")
+	s := CloudflareDns01Solver{Client: client, ZoneId: "zone1"}
+	ctx := context.Background()
+	chal := dnsChallenge("example.com", "token.thumbprint")
+	const name = "_acme-challenge.example.com"
+
+	// a record created unquoted, as from the dashboard
+	api.records = append(api.records, cloudflare.DNSRecord{Id: "manual", Type: "TXT", Name: name, Content: chal.DNS01KeyAuthorization()})
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if got := api.contents(name); len(got) != 1 {
+		t.Errorf("records = %v, want the existing record used", got)
+	}
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := api.contents(name); len(got) != 0 {
+		t.Errorf("records after CleanUp() = %v", got)
+	}
+}
+
+func TestCloudflareDns01SolverErrors(t *testing.T) {
+	api, client := newFakeCloudflare(t, "example.com")
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+
+	if err := (CloudflareDns01Solver{Client: client}).Present(ctx, dnsChallenge("www.example.org", "token.thumbprint")); err == nil || !strings.Contains(err.Error(), "zone not found") {
+		t.Errorf("Present() error = %v, want zone not found", err)
+	}
+	if err := (CloudflareDns01Solver{Client: client, ZoneId: "zone9"}).Present(ctx, chal); err == nil {
+		t.Error("Present() succeeded with an unknown zone id")
+	}
+
+	s := CloudflareDns01Solver{Client: client}
+	api.fail = "POST /zones/zone1/dns_records"
+	if err := s.Present(ctx, chal); err == nil || !strings.Contains(err.Error(), "DNS Validation Error (code 1004)") {
+		t.Errorf("Present() error = %v, want the API error", err)
+	}
+
+	api.fail = ""
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	api.fail = "DELETE /zones/zone1/dns_records/" + api.records[0].Id
+	if err := s.CleanUp(ctx, chal); err == nil || !strings.Contains(err.Error(), "failed to remove TXT record") {
+		t.Errorf("CleanUp() error = %v, want the API error", err)
+	}
+
+	api.fail = "GET /zones/zone1/dns_records"
+	if err := s.CleanUp(ctx, chal); err == nil || !strings.Contains(err.Error(), "failed to list TXT records") {
+		t.Errorf("CleanUp() error = %v, want the API error", err)
+	}
+}
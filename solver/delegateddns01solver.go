@@ -0,0 +1,83 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// DelegatedDns01Solver solves DNS-01 challenges for domains whose DNS is managed elsewhere. The owner of the
+// domain adds a CNAME record once from _acme-challenge.<domain> to <domain>.<ValidationZone>, a zone in
+// Records, and the TXT records of the challenges are written there.
+type DelegatedDns01Solver struct {
+	Records        TXTRecords
+	ValidationZone string
+	Resolvers      []string // resolvers to check the CNAME records with, the system resolvers when empty
+	WaitTimeout    time.Duration
+}
+
+// DelegationTarget returns the name in the validation zone that the challenge name of domain points to
+func (s DelegatedDns01Solver) DelegationTarget(domain string) string {
+	return strings.TrimPrefix(domain, "*.") + "." + strings.Trim(s.ValidationZone, ".") + "."
+}
+
+// Preflight checks that the CNAME record of every domain is in place, returning the records to add otherwise
+func (s DelegatedDns01Solver) Preflight(ctx context.Context, domains []string) error {
+	var missing []string
+	for _, domain := range domains {
+		name := challengeName(domain)
+		target, err := lookupCNAME(ctx, name, s.Resolvers)
+		if err != nil {
+			return err
+		}
+		expected := s.DelegationTarget(domain)
+		if strings.EqualFold(target, expected) {
+			continue
+		}
+		record := fmt.Sprintf("  %v CNAME %v", name, expected)
+		if target == "" {
+			record += " (no CNAME record found)"
+		} else {
+			record += fmt.Sprintf(" (found CNAME to %v)", target)
+		}
+		missing = append(missing, record)
+	}
+	if len(missing) > 0 {
+		return errors.New("DNS-01 validation is not delegated, add the following records to the DNS zones of the domains:\n" + strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+func (s DelegatedDns01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	target := s.DelegationTarget(chal.Identifier.Value)
+	log.Printf("Presenting challenge for domain %v with TXT record %v", chal.Identifier.Value, target)
+	return s.Records.AddTXT(ctx, target, chal.DNS01KeyAuthorization())
+}
+
+func (s DelegatedDns01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	target := s.DelegationTarget(chal.Identifier.Value)
+	log.Printf("Cleaning up challenge for domain %v with TXT record %v", chal.Identifier.Value, target)
+	return s.Records.RemoveTXT(ctx, target, chal.DNS01KeyAuthorization())
+}
+
+func (s DelegatedDns01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	target := s.DelegationTarget(chal.Identifier.Value)
+	log.Printf("Waiting for challenge for domain %v with TXT record %v", chal.Identifier.Value, target)
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+	if err := s.Records.WaitTXT(chkCtx, target, chal.DNS01KeyAuthorization()); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+// challengeName is the name of the DNS-01 TXT record of domain, the same for a wildcard and its base domain
+func challengeName(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+}
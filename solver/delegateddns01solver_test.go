@@ -0,0 +1,138 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cnameServer is a resolver answering CNAME queries with the targets by name, and SERVFAIL for the names
+// mapped to an empty target
+func cnameServer(t *testing.T, targets map[string]string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		target, ok := targets[strings.ToLower(q.Name)]
+		switch {
+		case ok && target == "":
+			m.Rcode = dns.RcodeServerFailure
+		case ok && q.Qtype == dns.TypeCNAME:
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target})
+		case !ok:
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// recordedTXT is a TXTRecords recording the calls
+type recordedTXT struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recordedTXT) record(op, name, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, op+" "+name+" "+value)
+	return nil
+}
+
+func (r *recordedTXT) AddTXT(ctx context.Context, name, value string) error {
+	return r.record("add", name, value)
+}
+
+func (r *recordedTXT) RemoveTXT(ctx context.Context, name, value string) error {
+	return r.record("remove", name, value)
+}
+
+func (r *recordedTXT) WaitTXT(ctx context.Context, name, value string) error {
+	return r.record("wait", name, value)
+}
+
+func TestDelegatedDns01SolverPreflight(t *testing.T) {
+	resolvers := []string{cnameServer(t, map[string]string{
+		"_acme-challenge.example.com.":     "example.com.acme.example.net.",
+		"_acme-challenge.www.example.com.": "WWW.example.com.acme.example.net.",
+		"_acme-challenge.api.example.com.": "api.example.com.other.example.net.",
+		"_acme-challenge.bad.example.com.": "",
+	})}
+	s := DelegatedDns01Solver{ValidationZone: "acme.example.net.", Resolvers: resolvers}
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		domains []string
+		want    []string // parts of the error, none when delegated
+	}{
+		{"delegated", []string{"example.com", "www.example.com"}, nil},
+		{"wildcard shares the base domain record", []string{"*.example.com", "example.com"}, nil},
+		{"not delegated", []string{"example.com", "new.example.com"}, []string{"_acme-challenge.new.example.com. CNAME new.example.com.acme.example.net. (no CNAME record found)"}},
+		{"wrong target", []string{"api.example.com"}, []string{"_acme-challenge.api.example.com. CNAME api.example.com.acme.example.net. (found CNAME to api.example.com.other.example.net.)"}},
+		{"all listed", []string{"new.example.com", "api.example.com"}, []string{"new.example.com.acme.example.net. (no CNAME", "(found CNAME to api.example.com.other.example.net.)"}},
+		{"lookup failure", []string{"bad.example.com"}, []string{"SERVFAIL"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Preflight(ctx, tt.domains)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Preflight() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Preflight() succeeded, want an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Preflight() error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDelegatedDns01Solver(t *testing.T) {
+	records := &recordedTXT{}
+	s := DelegatedDns01Solver{Records: records, ValidationZone: "acme.example.net", WaitTimeout: time.Second}
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+	value := chal.DNS01KeyAuthorization()
+
+	if target := s.DelegationTarget("*.example.com"); target != "example.com.acme.example.net." {
+		t.Errorf("DelegationTarget() = %v, want the target of the base domain", target)
+	}
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	const target = "www.example.com.acme.example.net."
+	if want := []string{"add " + target + " " + value, "wait " + target + " " + value, "remove " + target + " " + value}; !slices.Equal(records.calls, want) {
+		t.Errorf("calls = %v, want %v", records.calls, want)
+	}
+}
@@ -0,0 +1,116 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// waitForTXT polls each of the name servers, as host or host:port, until the TXT record name has value
+func waitForTXT(ctx context.Context, name, value string, nameservers []string) error {
+	name = strings.TrimSuffix(name, ".") + "."
+	servers, err := ResolverAddrs(nameservers)
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		log.Printf("Checking TXT record %v on %v", name, server)
+		if err := pollTXT(ctx, name, value, server); err != nil {
+			return fmt.Errorf("TXT record %v not found on %v: %w", name, server, err)
+		}
+	}
+	return nil
+}
+
+func pollTXT(ctx context.Context, name, value, server string) error {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeTXT)
+	// Ask the name server itself, not what it may have cached for other zones
+	msg.RecursionDesired = false
+	client := new(dns.Client)
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		if err == nil && hasTXT(resp, value) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasTXT(resp *dns.Msg, value string) bool {
+	for _, rr := range resp.Answer {
+		// Long values are split into several strings of one record
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCNAME returns the target of the CNAME record name, or an empty string when there is none, as answered
+// by the first of the resolvers, as host or host:port, or the system resolvers when none are given
+func lookupCNAME(ctx context.Context, name string, resolvers []string) (string, error) {
+	servers, err := ResolverAddrs(resolvers)
+	if err != nil {
+		return "", err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeCNAME)
+
+	var lastErr error
+	for _, server := range servers {
+		client := new(dns.Client)
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%v answered %v", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, dns.Fqdn(name)) {
+				return cname.Target, nil
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("failed to look up CNAME %v: %w", name, lastErr)
+}
+
+// ResolverAddrs returns the resolvers as host:port, or the system resolvers when none are given
+func ResolverAddrs(resolvers []string) ([]string, error) {
+	if len(resolvers) == 0 {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read resolver configuration: %w", err)
+		}
+		for _, server := range config.Servers {
+			resolvers = append(resolvers, net.JoinHostPort(server, config.Port))
+		}
+	}
+
+	addrs := make([]string, 0, len(resolvers))
+	for _, r := range resolvers {
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			r = net.JoinHostPort(strings.TrimSuffix(r, "."), "53")
+		}
+		addrs = append(addrs, r)
+	}
+	return addrs, nil
+}
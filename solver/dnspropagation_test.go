@@ -0,0 +1,95 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// txtServer is a name server answering TXT queries from the values it is given by name
+type txtServer struct {
+	mu     sync.Mutex
+	values map[string][]string
+	Addr   string
+}
+
+func newTXTServer(t *testing.T) *txtServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &txtServer{values: map[string][]string{}, Addr: pc.LocalAddr().String()}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Qtype == dns.TypeTXT {
+			s.mu.Lock()
+			for _, v := range s.values[q.Name] {
+				// character-strings are 255 bytes at most
+				var strs []string
+				for ; len(v) > 255; v = v[255:] {
+					strs = append(strs, v[:255])
+				}
+				m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: append(strs, v)})
+			}
+			s.mu.Unlock()
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return s
+}
+
+func (s *txtServer) Set(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[dns.Fqdn(name)] = values
+}
+
+func TestWaitForTXT(t *testing.T) {
+	first, second := newTXTServer(t), newTXTServer(t)
+	first.Set("_acme-challenge.example.com", "other", "value")
+	second.Set("_acme-challenge.example.com", "other")
+	nameservers := []string{first.Addr, second.Addr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := waitForTXT(ctx, "_acme-challenge.example.com", "value", nameservers); err == nil {
+		t.Fatal("waitForTXT() succeeded with the value missing on a name server")
+	}
+
+	second.Set("_acme-challenge.example.com", "value")
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForTXT(ctx, "_acme-challenge.example.com.", "value", nameservers); err != nil {
+		t.Fatalf("waitForTXT() error = %v", err)
+	}
+}
+
+func TestResolverAddrs(t *testing.T) {
+	got, err := ResolverAddrs([]string{"ns1.example.com.", "192.0.2.1", "192.0.2.2:5353", "2001:db8::1", "[2001:db8::2]:53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ns1.example.com:53", "192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::1]:53", "[2001:db8::2]:53"}
+	if len(got) != len(want) {
+		t.Fatalf("ResolverAddrs() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ResolverAddrs() = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+// checkAllAddrs polls http://host/path through every A and AAAA address of target until each of them returns
+// value, with host as Host header, so that a broken AAAA record or a load balancer node that has not picked up
+// the rule yet is waited for. target is the name whose addresses are dialed, with an optional port: the DNS
+// name of the load balancer to check each of its nodes, or host itself to check what the CA connects to. The
+// addresses are resolved with the resolvers, as host or host:port, or the system resolvers when none are given,
+// on every round as the load balancer nodes may change, and the nodes returned by any round have to serve the
+// challenge. An IPv6 address that cannot be reached from here is retried like any other, as the CA may still
+// use it, unless skipIPv6 is set to check the IPv4 addresses only.
+func checkAllAddrs(ctx context.Context, target, host, path, value string, resolvers []string, skipIPv6 bool) error {
+	name, port := target, ""
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		name, port = h, ":"+p
+	}
+	ready := map[netip.Addr]bool{}
+	pending := map[netip.Addr]error{}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return pendingError(ctx.Err(), pending)
+		case <-ticker.C:
+		}
+
+		addrs, err := lookupAddrs(ctx, name, resolvers)
+		if err != nil || len(addrs) == 0 {
+			log.Printf("No addresses for %v yet: %v", name, err)
+			continue
+		}
+
+		clear(pending)
+		for _, addr := range addrs {
+			if ready[addr] || (skipIPv6 && addr.Is6()) {
+				continue
+			}
+			err := getVia(ctx, addr, "http://"+host+port+path, host, value)
+			if err != nil && addr.Is6() && isUnreachable(err) {
+				err = fmt.Errorf("%w, skip the IPv6 check if this host has no IPv6 connectivity", err)
+			}
+			if err != nil {
+				pending[addr] = err
+				continue
+			}
+			log.Printf("Challenge for %v is served by %v", host, addr)
+			ready[addr] = true
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+	}
+}
+
+// checkAlbNodes polls the HTTP-01 challenge through every node of the load balancer, with the domain as Host
+// header, see checkAllAddrs
+func checkAlbNodes(ctx context.Context, albArn string, chal acme.Challenge, resolvers []string, skipIPv6 bool) error {
+	lb, err := alb.GetLoadBalancer(ctx, albArn)
+	if err != nil {
+		return fmt.Errorf("cannot get load balancer %v: %w", albArn, err)
+	}
+	albName := strings.TrimSuffix(strings.ToLower(*lb.DNSName), ".")
+	log.Printf("Checking URL http://%v%v on every node of %v", chal.Identifier.Value, chal.HTTP01ResourcePath(), albName)
+	return checkAllAddrs(ctx, albName, chal.Identifier.Value, chal.HTTP01ResourcePath(), chal.KeyAuthorization, resolvers, skipIPv6)
+}
+
+// getVia requests url with its connections to host dialed to addr, following redirects, and checks the
+// response body is value
+func getVia(ctx context.Context, addr netip.Addr, url, host, value string) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if h, port, err := net.SplitHostPort(address); err == nil && strings.EqualFold(h, host) {
+			address = net.JoinHostPort(addr.String(), port)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	// go http client defaults to follow 10 redirects which matches let's encrypt's limit
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %v", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if string(body) != value {
+		return errors.New("unexpected response body")
+	}
+	return nil
+}
+
+// lookupAddrs returns the A and AAAA addresses of host, following CNAME records
+func lookupAddrs(ctx context.Context, host string, resolvers []string) ([]netip.Addr, error) {
+	if len(resolvers) == 0 {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		return addrs, err
+	}
+
+	servers, err := ResolverAddrs(resolvers)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+
+		var lastErr error
+		answered := false
+		for _, server := range servers {
+			client := new(dns.Client)
+			resp, _, err := client.ExchangeContext(ctx, msg, server)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+				lastErr = fmt.Errorf("%v answered %v", server, dns.RcodeToString[resp.Rcode])
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+						addrs = append(addrs, addr)
+					}
+				case *dns.AAAA:
+					if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+						addrs = append(addrs, addr)
+					}
+				}
+			}
+			answered = true
+			break
+		}
+		if !answered {
+			return nil, fmt.Errorf("failed to look up %v of %v: %w", dns.TypeToString[qtype], host, lastErr)
+		}
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return slices.Compact(addrs), nil
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func pendingError(err error, pending map[netip.Addr]error) error {
+	if len(pending) == 0 {
+		return err
+	}
+	var details []string
+	for addr, perr := range pending {
+		details = append(details, fmt.Sprintf("%v: %v", addr, perr))
+	}
+	slices.Sort(details)
+	return fmt.Errorf("%w, not served by %v", err, strings.Join(details, "; "))
+}
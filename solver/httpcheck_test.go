@@ -0,0 +1,94 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// addrServer answers A queries for name with addrs
+func addrServer(t *testing.T, name string, addrs ...string) string {
+	t.Helper()
+	return aliasServer(t, map[string][]string{name: addrs})
+}
+
+// challengeNode is a stand-in of a load balancer node serving value at path for host once it has the rule
+type challengeNode struct {
+	hasRule atomic.Bool
+}
+
+func (n *challengeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !n.hasRule.Load() || r.URL.Path != "/.well-known/acme-challenge/token" || !strings.HasPrefix(r.Host, "www.example.com:") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte("token.thumbprint"))
+}
+
+// startNodes starts a node on 127.0.0.1 and 127.0.0.2 on the same port, returning the port
+func startNodes(t *testing.T, nodes ...*challengeNode) string {
+	t.Helper()
+	for range 10 {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(first.Addr().String())
+		second, err := net.Listen("tcp", "127.0.0.2:"+port)
+		if err != nil {
+			first.Close()
+			continue
+		}
+		for i, l := range []net.Listener{first, second} {
+			srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: nodes[i]}}
+			srv.Start()
+			t.Cleanup(srv.Close)
+		}
+		return port
+	}
+	t.Skip("no port free on both 127.0.0.1 and 127.0.0.2")
+	return ""
+}
+
+func TestCheckAllAddrs(t *testing.T) {
+	ready, missing := &challengeNode{}, &challengeNode{}
+	ready.hasRule.Store(true)
+	port := startNodes(t, ready, missing)
+	resolvers := []string{addrServer(t, "alb-123.us-east-1.elb.amazonaws.com", "127.0.0.1", "127.0.0.2")}
+	target := net.JoinHostPort("alb-123.us-east-1.elb.amazonaws.com", port)
+	const path, value = "/.well-known/acme-challenge/token", "token.thumbprint"
+
+	// a node missing the rule fails the check
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	err := checkAllAddrs(ctx, target, "www.example.com", path, value, resolvers, false)
+	if err == nil {
+		t.Fatal("checkAllAddrs() succeeded with a node missing the rule")
+	}
+	if !strings.Contains(err.Error(), "127.0.0.2") || strings.Contains(err.Error(), "127.0.0.1:") {
+		t.Errorf("checkAllAddrs() error = %v, want the node missing the rule only", err)
+	}
+
+	// and passes once the node picks up the rule
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		missing.hasRule.Store(true)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := checkAllAddrs(ctx, target, "www.example.com", path, value, resolvers, false); err != nil {
+		t.Fatalf("checkAllAddrs() error = %v", err)
+	}
+
+	// the wrong Host header is not served by any node
+	ctx, cancel = context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if err := checkAllAddrs(ctx, target, "api.example.com", path, value, resolvers, false); err == nil {
+		t.Error("checkAllAddrs() succeeded for a host without the rule")
+	}
+}
@@ -0,0 +1,217 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/DefangLabs/cloudacme/aws/ssm"
+	awsalb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/mholt/acmez/acme"
+)
+
+const (
+	ChallengePathPrefix       = "/.well-known/acme-challenge/"
+	DefaultChallengeSSMPrefix = "/cloudacme/challenges"
+	challengeRulePathPattern  = ChallengePathPrefix + "*"
+)
+
+var ErrChallengeNotFound = errors.New("challenge not found")
+
+// ChallengeStore keeps the key authorizations of pending HTTP-01 challenges by token
+type ChallengeStore interface {
+	Put(ctx context.Context, token, keyAuthorization string) error
+	// Get returns ErrChallengeNotFound for unknown tokens
+	Get(ctx context.Context, token string) (string, error)
+	Delete(ctx context.Context, token string) error
+}
+
+// SSMChallengeStore stores each key authorization in an SSM parameter named after its token
+type SSMChallengeStore struct {
+	Prefix string
+}
+
+func (s SSMChallengeStore) Put(ctx context.Context, token, keyAuthorization string) error {
+	return ssm.PutParameter(ctx, s.parameterName(token), keyAuthorization)
+}
+
+func (s SSMChallengeStore) Get(ctx context.Context, token string) (string, error) {
+	value, err := ssm.GetParameter(ctx, s.parameterName(token))
+	var notFoundErr *types.ParameterNotFound
+	if errors.As(err, &notFoundErr) {
+		return "", ErrChallengeNotFound
+	}
+	return value, err
+}
+
+func (s SSMChallengeStore) Delete(ctx context.Context, token string) error {
+	err := ssm.DeleteParameter(ctx, s.parameterName(token))
+	var notFoundErr *types.ParameterNotFound
+	if errors.As(err, &notFoundErr) {
+		return nil
+	}
+	return err
+}
+
+func (s SSMChallengeStore) parameterName(token string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultChallengeSSMPrefix
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + token
+}
+
+// LambdaHttp01Solver answers HTTP-01 challenges from the cloudacme lambda function. The key authorizations
+// are saved in Store, and a long lived rule per domain on the HTTP listener of the ALB forwards the
+// /.well-known/acme-challenge/ requests for the domain to the lambda function, which serves them with
+// ServeChallenge.
+type LambdaHttp01Solver struct {
+	AlbArn      string
+	LambdaArn   string
+	Store       ChallengeStore
+	Resolvers   []string // resolvers to look up the load balancer nodes with, the system resolvers when empty
+	WaitTimeout time.Duration
+	// SkipDnsCheck places the order without checking the domains point at the ALB
+	SkipDnsCheck bool
+	// SkipIPv6Check checks the challenge through the IPv4 addresses only
+	SkipIPv6Check bool
+	// FrontedDomains are served through a CDN in front of the ALB, such as the aliases of a CloudFront
+	// distribution with the ALB as origin, and are not checked to point at the ALB
+	FrontedDomains []string
+}
+
+// Preflight checks that every domain points at the ALB, so that the challenge requests reach the rule
+func (s LambdaHttp01Solver) Preflight(ctx context.Context, domains []string) error {
+	if s.SkipDnsCheck {
+		return nil
+	}
+	return checkPointsAtAlb(ctx, s.AlbArn, domains, s.FrontedDomains, s.Resolvers)
+}
+
+func (s LambdaHttp01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	if err := s.Store.Put(ctx, chal.Token, chal.KeyAuthorization); err != nil {
+		return fmt.Errorf("failed to save challenge: %w", err)
+	}
+	if err := s.ensureRule(ctx, chal.Identifier.Value); err != nil {
+		return fmt.Errorf("failed to setup challenge rule: %w", err)
+	}
+	return nil
+}
+
+// CleanUp deletes the saved challenge, the rule is kept for the next challenges
+func (s LambdaHttp01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	if err := s.Store.Delete(ctx, chal.Token); err != nil {
+		return fmt.Errorf("failed to delete challenge: %w", err)
+	}
+	return nil
+}
+
+func (s LambdaHttp01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Waiting for challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+
+	if err := checkAlbNodes(chkCtx, s.AlbArn, chal, s.Resolvers, s.SkipIPv6Check); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+// ensureRule creates the rule forwarding the challenge requests for host to the lambda function, kept for the
+// next orders of the domain. The rule of earlier versions forwarding the challenges of every host is deleted,
+// as the lambda function would answer the challenges of any host served by the listener through it.
+func (s LambdaHttp01Solver) ensureRule(ctx context.Context, host string) error {
+	listener, err := alb.GetListener(ctx, s.AlbArn, awsalb.ProtocolEnumHttp, 80)
+	if err != nil {
+		return fmt.Errorf("cannot get http listener: %w", err)
+	}
+	rules, err := alb.GetAllRules(ctx, *listener.ListenerArn)
+	if err != nil {
+		return fmt.Errorf("cannot get listener rules: %w", err)
+	}
+
+	ruleCond := challengeRuleCondition(host)
+	found, hostless := findChallengeRules(rules, ruleCond)
+	if err := s.deleteHostlessRules(ctx, hostless); err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	targetGroupArn, err := alb.GetLambdaTargetGroup(ctx, s.LambdaArn)
+	if err != nil {
+		return fmt.Errorf("cannot get target group for lambda %v: %w", s.LambdaArn, err)
+	}
+	log.Printf("Creating challenge rule for %v%v on ALB %v", ruleCond.HostHeader[0], challengeRulePathPattern, s.AlbArn)
+	return alb.AddListenerTriggerTargetGroupRule(ctx, *listener.ListenerArn, ruleCond, targetGroupArn, alb.RuleTypeLambdaChallenge)
+}
+
+// deleteHostlessRules deletes the rules forwarding the challenges of every host that cloudacme created
+func (s LambdaHttp01Solver) deleteHostlessRules(ctx context.Context, rules []awsalb.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	arns := make([]string, len(rules))
+	for i, rule := range rules {
+		arns[i] = *rule.RuleArn
+	}
+	tags, err := alb.GetTags(ctx, arns)
+	if err != nil {
+		return fmt.Errorf("cannot get tags of the challenge rules: %w", err)
+	}
+	for _, arn := range arns {
+		if tags[arn][alb.TagRuleType] != alb.RuleTypeLambdaChallenge {
+			continue
+		}
+		log.Printf("Deleting challenge rule %v for every host on ALB %v, the challenges get a rule per host", arn, s.AlbArn)
+		if err := alb.DeleteRule(ctx, arn); err != nil {
+			return fmt.Errorf("failed to delete challenge rule %v: %w", arn, err)
+		}
+	}
+	return nil
+}
+
+func challengeRuleCondition(host string) alb.RuleCondition {
+	return alb.RuleCondition{
+		HostHeader:  []string{strings.ToLower(host)},
+		PathPattern: []string{challengeRulePathPattern},
+	}
+}
+
+// findChallengeRules reports whether one of the rules is the challenge rule of ruleCond, along with the
+// challenge rules without a host condition
+func findChallengeRules(rules []awsalb.Rule, ruleCond alb.RuleCondition) (bool, []awsalb.Rule) {
+	found := false
+	var hostless []awsalb.Rule
+	for _, rule := range rules {
+		if alb.RuleConditionMatches(rule, ruleCond) {
+			found = true
+		} else if alb.RuleConditionMatches(rule, alb.RuleCondition{PathPattern: ruleCond.PathPattern}) && !hasHostCondition(rule) {
+			hostless = append(hostless, rule)
+		}
+	}
+	return found, hostless
+}
+
+func hasHostCondition(rule awsalb.Rule) bool {
+	return slices.ContainsFunc(rule.Conditions, func(c awsalb.RuleCondition) bool { return c.HostHeaderConfig != nil })
+}
+
+// ServeChallenge returns the key authorization for a request path under /.well-known/acme-challenge/
+func ServeChallenge(ctx context.Context, store ChallengeStore, path string) (string, error) {
+	token, ok := strings.CutPrefix(path, ChallengePathPrefix)
+	if !ok || token == "" || strings.Contains(token, "/") {
+		return "", ErrChallengeNotFound
+	}
+	return store.Get(ctx, token)
+}
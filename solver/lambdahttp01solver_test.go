@@ -0,0 +1,150 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	awsalb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/smithy-go/ptr"
+	"github.com/mholt/acmez/acme"
+)
+
+// memoryStore is a ChallengeStore in memory
+type memoryStore struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (s *memoryStore) Put(ctx context.Context, token, keyAuthorization string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]string)
+	}
+	s.values[token] = keyAuthorization
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[token]
+	if !ok {
+		return "", ErrChallengeNotFound
+	}
+	return value, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, token)
+	return nil
+}
+
+func httpChallenge(domain, token string) acme.Challenge {
+	return acme.Challenge{
+		Type:             acme.ChallengeTypeHTTP01,
+		Identifier:       acme.Identifier{Type: "dns", Value: domain},
+		Token:            token,
+		KeyAuthorization: token + ".thumbprint",
+	}
+}
+
+func TestServeChallenge(t *testing.T) {
+	store := &memoryStore{}
+	store.Put(context.Background(), "token", "token.thumbprint")
+	// the lambda function answers the requests the ALB forwards with ServeChallenge
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, err := ServeChallenge(r.Context(), store, r.URL.Path)
+		if errors.Is(err, ErrChallengeNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/.well-known/acme-challenge/token", http.StatusOK},
+		{"/.well-known/acme-challenge/other", http.StatusNotFound},
+		{"/.well-known/acme-challenge/", http.StatusNotFound},
+		{"/.well-known/acme-challenge/token/more", http.StatusNotFound},
+		{"/token", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %v = %v, want %v", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestLambdaHttp01SolverCleanUp(t *testing.T) {
+	store := &memoryStore{}
+	s := LambdaHttp01Solver{Store: store}
+	ctx := context.Background()
+	chal, other := httpChallenge("www.example.com", "token"), httpChallenge("www.example.com", "other")
+	store.Put(ctx, chal.Token, chal.KeyAuthorization)
+	store.Put(ctx, other.Token, other.KeyAuthorization)
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if _, err := ServeChallenge(ctx, store, chal.HTTP01ResourcePath()); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("ServeChallenge() error = %v after CleanUp(), want %v", err, ErrChallengeNotFound)
+	}
+	if value, err := ServeChallenge(ctx, store, other.HTTP01ResourcePath()); err != nil || value != other.KeyAuthorization {
+		t.Errorf("ServeChallenge() = %v, %v, want the other challenge kept", value, err)
+	}
+}
+
+func TestFindChallengeRules(t *testing.T) {
+	rule := func(arn string, conds ...awsalb.RuleCondition) awsalb.Rule {
+		return awsalb.Rule{RuleArn: ptr.String(arn), Conditions: conds}
+	}
+	path := awsalb.RuleCondition{Field: ptr.String("path-pattern"), PathPatternConfig: &awsalb.PathPatternConditionConfig{Values: []string{challengeRulePathPattern}}}
+	host := func(h string) awsalb.RuleCondition {
+		return awsalb.RuleCondition{Field: ptr.String("host-header"), HostHeaderConfig: &awsalb.HostHeaderConditionConfig{Values: []string{h}}}
+	}
+
+	tests := []struct {
+		name         string
+		rules        []awsalb.Rule
+		wantFound    bool
+		wantHostless []string
+	}{
+		{"no rules", nil, false, nil},
+		{"rule of the host", []awsalb.Rule{rule("other", path, host("api.example.com")), rule("www", path, host("www.example.com"))}, true, nil},
+		{"rule for every host", []awsalb.Rule{rule("all", path)}, false, []string{"all"}},
+		{"both", []awsalb.Rule{rule("all", path), rule("www", host("www.example.com"), path)}, true, []string{"all"}},
+		{"other paths", []awsalb.Rule{rule("root", awsalb.RuleCondition{Field: ptr.String("path-pattern"), PathPatternConfig: &awsalb.PathPatternConditionConfig{Values: []string{"/*"}}})}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, hostless := findChallengeRules(tt.rules, challengeRuleCondition("WWW.example.com"))
+			var arns []string
+			for _, r := range hostless {
+				arns = append(arns, *r.RuleArn)
+			}
+			if found != tt.wantFound || !slices.Equal(arns, tt.wantHostless) {
+				t.Errorf("findChallengeRules() = %v, %v, want %v, %v", found, arns, tt.wantFound, tt.wantHostless)
+			}
+		})
+	}
+	if cond := challengeRuleCondition("WWW.example.com"); cond.HostHeader[0] != "www.example.com" || len(cond.PathPattern) != 1 {
+		t.Errorf("challengeRuleCondition() = %+v, want the host and the challenge path", cond)
+	}
+}
@@ -0,0 +1,175 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+	"github.com/miekg/dns"
+)
+
+const DefaultTSIGAlgorithm = dns.HmacSHA256
+
+// RFC2136Dns01Solver solves DNS-01 challenges with TSIG signed dynamic updates (RFC 2136) sent to Server
+type RFC2136Dns01Solver struct {
+	Server        string // name server accepting updates, as host or host:port
+	Zone          string // zone to update, found from the SOA record when empty
+	TSIGKeyName   string
+	TSIGSecret    string   // base64 encoded
+	TSIGAlgorithm string   // DefaultTSIGAlgorithm when empty
+	Nameservers   []string // checked for propagation, as host or host:port, the NS records of the zone when empty
+	TTL           uint32
+	WaitTimeout   time.Duration
+}
+
+func (s RFC2136Dns01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.AddTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s RFC2136Dns01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.RemoveTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s RFC2136Dns01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Waiting for challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+	if err := s.WaitTXT(chkCtx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization()); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+// AddTXT adds the value to the record set, the other values of the TXT record are kept by the update
+func (s RFC2136Dns01Solver) AddTXT(ctx context.Context, name, value string) error {
+	if err := s.update(ctx, name, value, (*dns.Msg).Insert); err != nil {
+		return fmt.Errorf("failed to add TXT record %v: %w", name, err)
+	}
+	return nil
+}
+
+func (s RFC2136Dns01Solver) RemoveTXT(ctx context.Context, name, value string) error {
+	if err := s.update(ctx, name, value, (*dns.Msg).Remove); err != nil {
+		return fmt.Errorf("failed to remove TXT record %v: %w", name, err)
+	}
+	return nil
+}
+
+// WaitTXT waits for the record to be served by all the authoritative name servers of the zone
+func (s RFC2136Dns01Solver) WaitTXT(ctx context.Context, name, value string) error {
+	nameservers := s.Nameservers
+	if len(nameservers) == 0 {
+		zone, err := s.zone(ctx, name)
+		if err != nil {
+			return err
+		}
+		if nameservers, err = s.lookupNS(ctx, zone); err != nil {
+			return err
+		}
+	}
+	return waitForTXT(ctx, name, value, nameservers)
+}
+
+func (s RFC2136Dns01Solver) update(ctx context.Context, name, value string, op func(*dns.Msg, []dns.RR)) error {
+	zone, err := s.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultDnsTTL
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: []string{value},
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	op(msg, []dns.RR{rr})
+
+	resp, err := s.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of zone %v refused by %v: %v", zone, s.Server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// exchange sends msg to Server, signed with the TSIG key when configured
+func (s RFC2136Dns01Solver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// Updates are sent over TCP, they are not retransmitted like queries over UDP
+	client := &dns.Client{Net: "tcp"}
+	if s.TSIGKeyName != "" {
+		keyName := dns.Fqdn(s.TSIGKeyName)
+		algorithm := s.TSIGAlgorithm
+		if algorithm == "" {
+			algorithm = DefaultTSIGAlgorithm
+		}
+		client.TsigSecret = map[string]string{keyName: s.TSIGSecret}
+		msg.SetTsig(keyName, dns.Fqdn(algorithm), 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, s.serverAddr())
+	if err != nil {
+		return nil, fmt.Errorf("failed to send to %v: %w", s.Server, err)
+	}
+	return resp, nil
+}
+
+// zone returns Zone, or the zone of name according to the SOA record returned by Server
+func (s RFC2136Dns01Solver) zone(ctx context.Context, name string) (string, error) {
+	if s.Zone != "" {
+		return dns.Fqdn(s.Zone), nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+	resp, _, err := new(dns.Client).ExchangeContext(ctx, msg, s.serverAddr())
+	if err != nil {
+		return "", fmt.Errorf("failed to look up zone of %v: %w", name, err)
+	}
+	// The SOA record is in the answer for the zone apex, or in the authority section for names below it
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no zone found for %v on %v", name, s.Server)
+}
+
+func (s RFC2136Dns01Solver) lookupNS(ctx context.Context, zone string) ([]string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(zone, dns.TypeNS)
+	resp, _, err := new(dns.Client).ExchangeContext(ctx, msg, s.serverAddr())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up name servers of %v: %w", zone, err)
+	}
+	var nameservers []string
+	for _, rr := range resp.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			nameservers = append(nameservers, ns.Ns)
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no name servers found for %v on %v", zone, s.Server)
+	}
+	return nameservers, nil
+}
+
+func (s RFC2136Dns01Solver) serverAddr() string {
+	if _, _, err := net.SplitHostPort(s.Server); err != nil {
+		return net.JoinHostPort(strings.TrimSuffix(s.Server, "."), "53")
+	}
+	return s.Server
+}
@@ -0,0 +1,230 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGKey    = "cloudacme."
+	testTSIGSecret = "c2VjcmV0IGtleSBmb3IgdGhlIHRlc3Qgb2YgdXBkYXRlcw=="
+)
+
+// updateServer is an authoritative name server of zone accepting dynamic updates signed with the test TSIG key
+type updateServer struct {
+	mu      sync.Mutex
+	zone    string
+	values  map[string][]string // TXT values by name
+	updates []string            // TSIG key names of the accepted updates
+	Addr    string
+}
+
+func newUpdateServer(t *testing.T, zone string) *updateServer {
+	t.Helper()
+	s := &updateServer{zone: zone, values: map[string][]string{}}
+
+	// Queries are sent over UDP and updates over TCP, to the same port
+	var l net.Listener
+	var pc net.PacketConn
+	for range 10 {
+		var err error
+		if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if pc, err = net.ListenPacket("udp", l.Addr().String()); err == nil {
+			break
+		}
+		l.Close()
+	}
+	if pc == nil {
+		t.Fatal("no port free for both TCP and UDP")
+	}
+	s.Addr = l.Addr().String()
+
+	acceptUpdates := func(dh dns.Header) dns.MsgAcceptAction {
+		if int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+			return dns.MsgAccept
+		}
+		return dns.DefaultMsgAcceptFunc(dh)
+	}
+	for _, srv := range []*dns.Server{
+		{Listener: l, Handler: s, TsigSecret: map[string]string{testTSIGKey: testTSIGSecret}, MsgAcceptFunc: acceptUpdates},
+		{PacketConn: pc, Handler: s, TsigSecret: map[string]string{testTSIGKey: testTSIGSecret}, MsgAcceptFunc: acceptUpdates},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return s
+}
+
+func (s *updateServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	defer w.WriteMsg(m)
+
+	if r.Opcode != dns.OpcodeUpdate {
+		q := r.Question[0]
+		soa := &dns.SOA{Hdr: dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60}, Ns: "ns1." + s.zone, Mbox: "hostmaster." + s.zone, Serial: 1, Refresh: 60, Retry: 60, Expire: 60, Minttl: 60}
+		switch {
+		case !dns.IsSubDomain(s.zone, q.Name):
+			m.Rcode = dns.RcodeRefused
+		case q.Qtype == dns.TypeSOA && q.Name == s.zone:
+			m.Answer = append(m.Answer, soa)
+		case q.Qtype == dns.TypeNS && q.Name == s.zone:
+			for _, ns := range []string{"ns1.", "ns2."} {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: dns.RR_Header{Name: s.zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: ns + s.zone})
+			}
+		case q.Qtype == dns.TypeTXT && len(s.values[q.Name]) > 0:
+			for _, v := range s.values[q.Name] {
+				m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{v}})
+			}
+		default:
+			m.Ns = append(m.Ns, soa)
+		}
+		return
+	}
+
+	tsig := r.IsTsig()
+	switch {
+	case tsig == nil:
+		m.Rcode = dns.RcodeRefused
+		return
+	case w.TsigStatus() != nil:
+		m.Rcode = dns.RcodeNotAuth
+		return
+	case r.Question[0].Name != s.zone:
+		m.Rcode = dns.RcodeNotZone
+	default:
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				m.Rcode = dns.RcodeFormatError
+				break
+			}
+			value := strings.Join(txt.Txt, "")
+			values := slices.DeleteFunc(s.values[txt.Hdr.Name], func(v string) bool { return v == value })
+			if txt.Hdr.Class == dns.ClassINET {
+				values = append(values, value)
+			}
+			s.values[txt.Hdr.Name] = values
+		}
+		s.updates = append(s.updates, tsig.Hdr.Name)
+	}
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+}
+
+func (s *updateServer) txt(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.values[name])
+}
+
+func TestRFC2136Dns01Solver(t *testing.T) {
+	server := newUpdateServer(t, "example.com.")
+	s := RFC2136Dns01Solver{
+		Server:      server.Addr,
+		TSIGKeyName: "cloudacme",
+		TSIGSecret:  testTSIGSecret,
+		Nameservers: []string{server.Addr},
+		WaitTimeout: 5 * time.Second,
+	}
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+	other := dnsChallenge("www.example.com", "token2.thumbprint")
+	const name = "_acme-challenge.www.example.com."
+
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if err := s.Present(ctx, other); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if got := server.txt(name); !slices.Equal(got, []string{chal.DNS01KeyAuthorization(), other.DNS01KeyAuthorization()}) {
+		t.Fatalf("record = %v, want both values", got)
+	}
+	if err := s.Wait(ctx, chal); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := server.txt(name); !slices.Equal(got, []string{other.DNS01KeyAuthorization()}) {
+		t.Errorf("record after CleanUp() = %v, want the other value kept", got)
+	}
+	if !slices.Equal(server.updates, []string{testTSIGKey, testTSIGKey, testTSIGKey}) {
+		t.Errorf("updates = %v, want all signed with %v", server.updates, testTSIGKey)
+	}
+}
+
+func TestRFC2136Dns01SolverZone(t *testing.T) {
+	server := newUpdateServer(t, "example.com.")
+	s := RFC2136Dns01Solver{Server: server.Addr}
+	ctx := context.Background()
+
+	for _, name := range []string{"example.com", "_acme-challenge.www.example.com"} {
+		zone, err := s.zone(ctx, name)
+		if err != nil {
+			t.Fatalf("zone(%v) error = %v", name, err)
+		}
+		if zone != "example.com." {
+			t.Errorf("zone(%v) = %v, want example.com.", name, zone)
+		}
+	}
+	if zone, err := s.zone(ctx, "www.example.org"); err == nil {
+		t.Errorf("zone() = %v, want error for a name the server is not authoritative for", zone)
+	}
+	if zone, _ := (RFC2136Dns01Solver{Server: server.Addr, Zone: "example.com"}).zone(ctx, "www.example.org"); zone != "example.com." {
+		t.Errorf("zone() = %v, want the configured zone", zone)
+	}
+
+	nameservers, err := s.lookupNS(ctx, "example.com.")
+	if err != nil {
+		t.Fatalf("lookupNS() error = %v", err)
+	}
+	if !slices.Equal(nameservers, []string{"ns1.example.com.", "ns2.example.com."}) {
+		t.Errorf("lookupNS() = %v", nameservers)
+	}
+}
+
+func TestRFC2136Dns01SolverErrors(t *testing.T) {
+	server := newUpdateServer(t, "example.com.")
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+
+	tests := []struct {
+		name   string
+		solver RFC2136Dns01Solver
+		want   string
+	}{
+		{"unsigned", RFC2136Dns01Solver{Server: server.Addr}, "REFUSED"},
+		{"wrong secret", RFC2136Dns01Solver{Server: server.Addr, TSIGKeyName: "cloudacme", TSIGSecret: "b3RoZXIgc2VjcmV0"}, "NOTAUTH"},
+		{"unknown key", RFC2136Dns01Solver{Server: server.Addr, TSIGKeyName: "other", TSIGSecret: testTSIGSecret}, "NOTAUTH"},
+		{"other zone", RFC2136Dns01Solver{Server: server.Addr, Zone: "example.org", TSIGKeyName: "cloudacme", TSIGSecret: testTSIGSecret}, "NOTZONE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.solver.Present(ctx, chal); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Present() error = %v, want %v", err, tt.want)
+			}
+			if err := tt.solver.CleanUp(ctx, chal); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("CleanUp() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if len(server.updates) != 0 || len(server.txt("_acme-challenge.www.example.com.")) != 0 {
+		t.Errorf("updates = %v, want none accepted", server.updates)
+	}
+}
@@ -0,0 +1,169 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/route53"
+	"github.com/mholt/acmez/acme"
+)
+
+const DefaultDnsTTL = 60
+
+// TXTRecords manages the TXT records of DNS-01 challenges with a DNS provider
+type TXTRecords interface {
+	// AddTXT adds value to the TXT record name, keeping its other values
+	AddTXT(ctx context.Context, name, value string) error
+	RemoveTXT(ctx context.Context, name, value string) error
+	// WaitTXT waits until value is served in the TXT record name by the authoritative name servers
+	WaitTXT(ctx context.Context, name, value string) error
+}
+
+// Route53Dns01Solver solves DNS-01 challenges with TXT records in the Route53 hosted zone of the domain.
+// Challenges for the same name, such as example.com and *.example.com, share the record, each adds its value.
+type Route53Dns01Solver struct {
+	HostedZoneId string   // found from the domain when empty
+	Endpoint     string   // Route53 API endpoint, for a local Route53 stand-in
+	Nameservers  []string // checked for propagation, as host or host:port, the name servers of the zone when empty
+	TTL          int64
+	WaitTimeout  time.Duration
+
+	mu      sync.Mutex
+	changes map[string]string // change ID by record name and value
+}
+
+func (s *Route53Dns01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.AddTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s *Route53Dns01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	return s.RemoveTXT(ctx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization())
+}
+
+func (s *Route53Dns01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Waiting for challenge for domain %v with TXT record %v", chal.Identifier.Value, chal.DNS01TXTRecordName())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+	if err := s.WaitTXT(chkCtx, chal.DNS01TXTRecordName(), chal.DNS01KeyAuthorization()); err != nil {
+		return fmt.Errorf("failed waiting for challenge: %w", err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+func (s *Route53Dns01Solver) AddTXT(ctx context.Context, name, value string) error {
+	changeId, err := s.updateValues(ctx, name, func(values []string) []string {
+		if slices.Contains(values, value) {
+			return values
+		}
+		return append(values, value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add TXT record %v: %w", name, err)
+	}
+
+	if changeId == "" {
+		// The value was there already, keep waiting for the change that added it
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changes == nil {
+		s.changes = make(map[string]string)
+	}
+	s.changes[name+" "+value] = changeId
+	return nil
+}
+
+func (s *Route53Dns01Solver) RemoveTXT(ctx context.Context, name, value string) error {
+	if _, err := s.updateValues(ctx, name, func(values []string) []string {
+		return slices.DeleteFunc(values, func(v string) bool { return v == value })
+	}); err != nil {
+		return fmt.Errorf("failed to remove TXT record %v: %w", name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.changes, name+" "+value)
+	return nil
+}
+
+// WaitTXT waits for the change to be INSYNC, then for the record to be served by the authoritative name servers
+func (s *Route53Dns01Solver) WaitTXT(ctx context.Context, name, value string) error {
+	s.mu.Lock()
+	changeId := s.changes[name+" "+value]
+	s.mu.Unlock()
+
+	if changeId != "" {
+		client := route53.Client{Endpoint: s.Endpoint}
+		timeout := DefaultWaitTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if err := client.WaitForChange(ctx, changeId, timeout); err != nil {
+			return fmt.Errorf("failed waiting for change %v: %w", changeId, err)
+		}
+	}
+
+	nameservers := s.Nameservers
+	if len(nameservers) == 0 {
+		zone, err := s.hostedZone(ctx, name)
+		if err != nil {
+			return err
+		}
+		nameservers = zone.NameServers
+	}
+	return waitForTXT(ctx, name, value, nameservers)
+}
+
+// updateValues reads the values of the TXT record and writes the values returned by update back
+func (s *Route53Dns01Solver) updateValues(ctx context.Context, name string, update func([]string) []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zone, err := s.hostedZone(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	client := route53.Client{Endpoint: s.Endpoint}
+	old, err := client.GetTXTValues(ctx, zone.Id, name)
+	if err != nil {
+		return "", err
+	}
+	values := update(slices.Clone(old))
+	if slices.Equal(old, values) {
+		return "", nil
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultDnsTTL
+	}
+	return client.SetTXTValues(ctx, zone.Id, name, old, values, ttl)
+}
+
+func (s *Route53Dns01Solver) hostedZone(ctx context.Context, name string) (*route53.HostedZone, error) {
+	client := route53.Client{Endpoint: s.Endpoint}
+	if s.HostedZoneId != "" {
+		return client.GetHostedZone(ctx, s.HostedZoneId)
+	}
+	zone, err := client.FindHostedZone(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find hosted zone of %v: %w", name, err)
+	}
+	return zone, nil
+}
+
+func withWaitTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		timeout = DefaultWaitTimeout
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("timeout waiting for challenge after %v", timeout))
+}
@@ -0,0 +1,396 @@
+package solver
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type route53Zone struct {
+	Id      string
+	Name    string
+	Private bool
+}
+
+type route53Change struct {
+	Action            string
+	ResourceRecordSet struct {
+		Name            string
+		Type            string
+		TTL             int64
+		ResourceRecords []struct {
+			Value string
+		} `xml:"ResourceRecords>ResourceRecord"`
+	}
+}
+
+// fakeRoute53 is a stand-in of the Route53 API for the hosted zones, TXT record sets and changes used by the
+// solver, publishing the TXT records on ns. A change is reported PENDING the first time it is read.
+type fakeRoute53 struct {
+	mu      sync.Mutex
+	zones   []route53Zone
+	records map[string]map[string][]string // values by zone id and record name
+	ttls    map[string]int64
+	changes map[string]int // reads by change id
+	batches []route53Change
+	ns      *txtServer
+
+	rejectChanges string // message of an InvalidChangeBatch error for all changes
+}
+
+func newFakeRoute53(t *testing.T, zones ...route53Zone) (*fakeRoute53, string) {
+	t.Helper()
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	api := &fakeRoute53{
+		zones:   zones,
+		records: map[string]map[string][]string{},
+		ttls:    map[string]int64{},
+		changes: map[string]int{},
+		ns:      newTXTServer(t),
+	}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv.URL
+}
+
+// zoneOrder sorts names as Route53 lists hosted zones by name, on the labels from right to left
+func zoneOrder(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	slices.Reverse(labels)
+	return strings.Join(labels, ".")
+}
+
+func (api *fakeRoute53) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/2013-04-01/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && path == "hostedzonesbyname":
+		zones := slices.Clone(api.zones)
+		sort.Slice(zones, func(i, j int) bool { return zoneOrder(zones[i].Name) < zoneOrder(zones[j].Name) })
+		maxItems, _ := strconv.Atoi(query.Get("maxitems"))
+		var b strings.Builder
+		for _, z := range zones {
+			if zoneOrder(z.Name) < zoneOrder(query.Get("dnsname")) || maxItems == 0 {
+				continue
+			}
+			maxItems--
+			b.WriteString(z.xml())
+		}
+		fmt.Fprintf(w, `<ListHostedZonesByNameResponse><HostedZones>%s</HostedZones><IsTruncated>false</IsTruncated><MaxItems>%v</MaxItems></ListHostedZonesByNameResponse>`, b.String(), query.Get("maxitems"))
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "hostedzone":
+		z, ok := api.zone(parts[1])
+		if !ok {
+			api.error(w, http.StatusNotFound, "NoSuchHostedZone", "No hosted zone found with ID: "+parts[1])
+			return
+		}
+		fmt.Fprintf(w, `<GetHostedZoneResponse>%s<DelegationSet><NameServers><NameServer>%s</NameServer></NameServers></DelegationSet></GetHostedZoneResponse>`, z.xml(), api.ns.Addr)
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "rrset":
+		if _, ok := api.zone(parts[1]); !ok {
+			api.error(w, http.StatusNotFound, "NoSuchHostedZone", "No hosted zone found with ID: "+parts[1])
+			return
+		}
+		// the record sets from the start name on, there is one at most with the stand-in
+		var b strings.Builder
+		name := strings.ToLower(query.Get("name"))
+		if values, ok := api.records[parts[1]][name]; ok && query.Get("type") == "TXT" {
+			fmt.Fprintf(&b, `<ResourceRecordSet><Name>%s</Name><Type>TXT</Type><TTL>%d</TTL><ResourceRecords>`, name, api.ttls[name])
+			for _, v := range values {
+				fmt.Fprintf(&b, `<ResourceRecord><Value>%s</Value></ResourceRecord>`, escapeXML(v))
+			}
+			b.WriteString(`</ResourceRecords></ResourceRecordSet>`)
+		}
+		fmt.Fprintf(w, `<ListResourceRecordSetsResponse><ResourceRecordSets>%s</ResourceRecordSets><IsTruncated>false</IsTruncated><MaxItems>1</MaxItems></ListResourceRecordSetsResponse>`, b.String())
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[2] == "rrset":
+		var req struct {
+			Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			api.error(w, http.StatusBadRequest, "InvalidInput", err.Error())
+			return
+		}
+		if _, ok := api.zone(parts[1]); !ok {
+			api.error(w, http.StatusNotFound, "NoSuchHostedZone", "No hosted zone found with ID: "+parts[1])
+			return
+		}
+		if api.rejectChanges != "" {
+			api.error(w, http.StatusBadRequest, "InvalidChangeBatch", api.rejectChanges)
+			return
+		}
+		if api.records[parts[1]] == nil {
+			api.records[parts[1]] = map[string][]string{}
+		}
+		for _, c := range req.Changes {
+			rrs := c.ResourceRecordSet
+			name := strings.ToLower(rrs.Name)
+			var values []string
+			for _, rr := range rrs.ResourceRecords {
+				values = append(values, rr.Value)
+			}
+			switch c.Action {
+			case "UPSERT":
+				api.records[parts[1]][name] = values
+				api.ttls[name] = rrs.TTL
+			case "DELETE":
+				// the record set to delete must match the current one
+				if !slices.Equal(api.records[parts[1]][name], values) {
+					api.error(w, http.StatusBadRequest, "InvalidChangeBatch", fmt.Sprintf("Tried to delete resource record set [name='%v', type='TXT'] but the values provided do not match the current values", name))
+					return
+				}
+				delete(api.records[parts[1]], name)
+			default:
+				api.error(w, http.StatusBadRequest, "InvalidInput", "unexpected action "+c.Action)
+				return
+			}
+			var texts []string
+			for _, v := range api.records[parts[1]][name] {
+				texts = append(texts, txtText(v))
+			}
+			api.ns.Set(name, texts...)
+		}
+		api.batches = append(api.batches, req.Changes...)
+		id := fmt.Sprintf("C%d", len(api.batches))
+		api.changes[id] = 0
+		fmt.Fprintf(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/%s</Id><Status>PENDING</Status><SubmittedAt>2024-06-01T00:00:00Z</SubmittedAt></ChangeInfo></ChangeResourceRecordSetsResponse>`, id)
+	case r.Method == http.MethodGet && len(parts) >= 2 && parts[0] == "change":
+		id := parts[len(parts)-1]
+		reads, ok := api.changes[id]
+		if !ok {
+			api.error(w, http.StatusNotFound, "NoSuchChange", "Could not find resource with ID: "+id)
+			return
+		}
+		api.changes[id] = reads + 1
+		status := "INSYNC"
+		if reads == 0 {
+			status = "PENDING"
+		}
+		fmt.Fprintf(w, `<GetChangeResponse><ChangeInfo><Id>/change/%s</Id><Status>%s</Status><SubmittedAt>2024-06-01T00:00:00Z</SubmittedAt></ChangeInfo></GetChangeResponse>`, id, status)
+	default:
+		api.error(w, http.StatusNotFound, "UnknownOperationException", r.Method+" "+r.URL.Path)
+	}
+}
+
+func (api *fakeRoute53) zone(id string) (route53Zone, bool) {
+	for _, z := range api.zones {
+		if z.Id == id {
+			return z, true
+		}
+	}
+	return route53Zone{}, false
+}
+
+func (api *fakeRoute53) error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>test</RequestId></ErrorResponse>`, code, escapeXML(message))
+}
+
+func (api *fakeRoute53) values(zoneId, name string) []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.records[zoneId][name]
+}
+
+func (z route53Zone) xml() string {
+	return fmt.Sprintf(`<HostedZone><Id>/hostedzone/%s</Id><Name>%s</Name><CallerReference>%s</CallerReference><Config><PrivateZone>%v</PrivateZone></Config><ResourceRecordSetCount>2</ResourceRecordSetCount></HostedZone>`, z.Id, z.Name, z.Id, z.Private)
+}
+
+// txtStrings matches the quoted character-strings of a TXT value
+var txtStrings = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// txtText joins the character-strings of a TXT value as the name servers serve them
+func txtText(value string) string {
+	var text strings.Builder
+	for _, s := range txtStrings.FindAllString(value, -1) {
+		u, _ := strconv.Unquote(s)
+		text.WriteString(u)
+	}
+	return text.String()
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func TestRoute53HostedZone(t *testing.T) {
+	_, endpoint := newFakeRoute53(t,
+		route53Zone{Id: "ZCOM", Name: "example.com."},
+		route53Zone{Id: "ZEU", Name: "eu.example.com."},
+		route53Zone{Id: "ZPRIVATE", Name: "internal.example.com.", Private: true},
+		route53Zone{Id: "ZORG", Name: "example.org."},
+		route53Zone{Id: "ZNET", Name: "a.example.net."},
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"_acme-challenge.example.com", "ZCOM"},
+		{"_acme-challenge.www.example.com.", "ZCOM"},
+		{"_acme-challenge.eu.example.com", "ZEU"},
+		{"_acme-challenge.api.eu.example.com", "ZEU"},
+		{"_acme-challenge.host.internal.example.com", "ZCOM"},
+		{"_acme-challenge.Example.ORG", "ZORG"},
+		{"_acme-challenge.b.example.net", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Route53Dns01Solver{Endpoint: endpoint}
+			zone, err := s.hostedZone(ctx, tt.name)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("hostedZone() = %v, want error", zone.Id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("hostedZone() error = %v", err)
+			}
+			if zone.Id != tt.want {
+				t.Errorf("hostedZone() = %v, want %v", zone.Id, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoute53Dns01Solver(t *testing.T) {
+	api, endpoint := newFakeRoute53(t, route53Zone{Id: "ZCOM", Name: "example.com."}, route53Zone{Id: "ZEU", Name: "eu.example.com."})
+	s := &Route53Dns01Solver{Endpoint: endpoint, WaitTimeout: 30 * time.Second}
+	ctx := context.Background()
+	// a name and its wildcard share the record
+	chal := dnsChallenge("www.eu.example.com", "token.thumbprint")
+	wildcard := dnsChallenge("www.eu.example.com", "token2.thumbprint")
+	const name = "_acme-challenge.www.eu.example.com."
+	quoted := strconv.Quote(chal.DNS01KeyAuthorization())
+	quotedWildcard := strconv.Quote(wildcard.DNS01KeyAuthorization())
+
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if err := s.Present(ctx, wildcard); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	if got := api.values("ZEU", name); !slices.Equal(got, []string{quoted, quotedWildcard}) {
+		t.Fatalf("record = %v, want both values", got)
+	}
+	if api.ttls[name] != DefaultDnsTTL {
+		t.Errorf("TTL = %v, want %v", api.ttls[name], DefaultDnsTTL)
+	}
+	if len(api.batches) != 2 || api.batches[0].Action != "UPSERT" || api.batches[1].Action != "UPSERT" {
+		t.Errorf("changes = %+v, want an UPSERT for each value", api.batches)
+	}
+
+	// the change is waited for until INSYNC, then the record on the name servers of the zone
+	if err := s.Wait(ctx, chal); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if reads := api.changes["C1"]; reads < 2 {
+		t.Errorf("change read %d times, want it polled until INSYNC", reads)
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := api.values("ZEU", name); !slices.Equal(got, []string{quotedWildcard}) {
+		t.Errorf("record after CleanUp() = %v, want the other value kept", got)
+	}
+	if err := s.CleanUp(ctx, wildcard); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := api.values("ZEU", name); got != nil {
+		t.Errorf("record after CleanUp() = %v, want it deleted", got)
+	}
+	if last := api.batches[len(api.batches)-1]; last.Action != "DELETE" {
+		t.Errorf("last change = %v, want DELETE", last.Action)
+	}
+	n := len(api.batches)
+	if err := s.CleanUp(ctx, wildcard); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if len(api.batches) != n {
+		t.Error("CleanUp() of a deleted record made a change")
+	}
+}
+
+func TestRoute53Dns01SolverErrors(t *testing.T) {
+	api, endpoint := newFakeRoute53(t, route53Zone{Id: "ZCOM", Name: "example.com."})
+	ctx := context.Background()
+	chal := dnsChallenge("www.example.com", "token.thumbprint")
+
+	if err := (&Route53Dns01Solver{Endpoint: endpoint}).Present(ctx, dnsChallenge("www.example.org", "token.thumbprint")); err == nil || !strings.Contains(err.Error(), "hosted zone not found") {
+		t.Errorf("Present() error = %v, want hosted zone not found", err)
+	}
+	if err := (&Route53Dns01Solver{Endpoint: endpoint, HostedZoneId: "ZMISSING"}).Present(ctx, chal); err == nil || !strings.Contains(err.Error(), "NoSuchHostedZone") {
+		t.Errorf("Present() error = %v, want NoSuchHostedZone", err)
+	}
+
+	s := &Route53Dns01Solver{Endpoint: endpoint, HostedZoneId: "ZCOM", WaitTimeout: time.Second}
+	api.rejectChanges = "RRSet of type TXT with DNS name _acme-challenge.www.example.com. is not permitted"
+	if err := s.Present(ctx, chal); err == nil || !strings.Contains(err.Error(), "InvalidChangeBatch") || !strings.Contains(err.Error(), "failed to add TXT record") {
+		t.Errorf("Present() error = %v, want InvalidChangeBatch", err)
+	}
+	if err := s.Wait(ctx, chal); err == nil {
+		t.Error("Wait() succeeded for a record that was not added")
+	}
+
+	api.rejectChanges = ""
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatal(err)
+	}
+	api.rejectChanges = "Tried to delete resource record set but it was not found"
+	if err := s.CleanUp(ctx, chal); err == nil || !strings.Contains(err.Error(), "failed to remove TXT record") {
+		t.Errorf("CleanUp() error = %v, want InvalidChangeBatch", err)
+	}
+}
+
+func TestRoute53Dns01SolverMultiString(t *testing.T) {
+	api, endpoint := newFakeRoute53(t, route53Zone{Id: "ZCOM", Name: "example.com."})
+	s := &Route53Dns01Solver{Endpoint: endpoint, WaitTimeout: 30 * time.Second}
+	ctx := context.Background()
+	chal := dnsChallenge("example.com", "token.thumbprint")
+	const name = "_acme-challenge.example.com."
+
+	// a value of the record split in several character-strings, as long values are
+	long := strings.Repeat("a", 260)
+	api.records["ZCOM"] = map[string][]string{name: {`"other " "value"`, strconv.Quote(long[:200]) + " " + strconv.Quote(long[200:])}}
+
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	quoted := strconv.Quote(chal.DNS01KeyAuthorization())
+	want := []string{`"other value"`, strconv.Quote(long[:255]) + " " + strconv.Quote(long[255:]), quoted}
+	if got := api.values("ZCOM", name); !slices.Equal(got, want) {
+		t.Fatalf("record = %v, want the values kept and %v added", got, quoted)
+	}
+	if err := s.Wait(ctx, chal); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if got := api.values("ZCOM", name); !slices.Equal(got, want[:2]) {
+		t.Errorf("record after CleanUp() = %v, want the other values kept", got)
+	}
+}
@@ -0,0 +1,222 @@
+package solver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+const (
+	DefaultHttpAddr    = ":80"
+	DefaultTlsAlpnAddr = ":443"
+)
+
+// StandaloneHttp01Solver answers HTTP-01 challenges with its own HTTP server on Addr. The server listens
+// from the first Present until the last CleanUp of the order.
+type StandaloneHttp01Solver struct {
+	Addr string
+
+	mu      sync.Mutex
+	server  *http.Server
+	answers map[string]string // key authorization by challenge path
+}
+
+// Preflight checks that the address can be bound before the order is placed
+func (s *StandaloneHttp01Solver) Preflight(ctx context.Context, domains []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil {
+		return nil
+	}
+	ln, err := listen(s.addr(), "HTTP-01")
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+func (s *StandaloneHttp01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting challenge for domain %v at path %v on %v", chal.Identifier.Value, chal.HTTP01ResourcePath(), s.addr())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.answers == nil {
+		s.answers = make(map[string]string)
+	}
+	s.answers[chal.HTTP01ResourcePath()] = chal.KeyAuthorization
+
+	if s.server == nil {
+		ln, err := listen(s.addr(), "HTTP-01")
+		if err != nil {
+			return err
+		}
+		s.server = &http.Server{Handler: http.HandlerFunc(s.serveChallenge)}
+		go serve(s.server, ln)
+	}
+	return nil
+}
+
+func (s *StandaloneHttp01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	s.mu.Lock()
+	delete(s.answers, chal.HTTP01ResourcePath())
+	var server *http.Server
+	if len(s.answers) == 0 {
+		server, s.server = s.server, nil
+	}
+	s.mu.Unlock()
+
+	// shut down without the lock, as Shutdown waits for the requests in flight which take it
+	if server != nil {
+		return server.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (s *StandaloneHttp01Solver) serveChallenge(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	answer, ok := s.answers[r.URL.Path]
+	s.mu.Unlock()
+
+	if r.Method != http.MethodGet || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Answering HTTP-01 challenge for %v from %v", r.Host, r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(answer))
+}
+
+func (s *StandaloneHttp01Solver) addr() string {
+	if s.Addr == "" {
+		return DefaultHttpAddr
+	}
+	return s.Addr
+}
+
+// StandaloneTlsAlpn01Solver answers TLS-ALPN-01 challenges with its own TLS listener on Addr. The listener
+// is open from the first Present until the last CleanUp of the order.
+type StandaloneTlsAlpn01Solver struct {
+	Addr string
+
+	mu       sync.Mutex
+	listener net.Listener
+	certs    map[string]*tls.Certificate // challenge certificate by domain
+}
+
+// Preflight checks that the address can be bound before the order is placed
+func (s *StandaloneTlsAlpn01Solver) Preflight(ctx context.Context, domains []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	ln, err := listen(s.addr(), "TLS-ALPN-01")
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+func (s *StandaloneTlsAlpn01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Presenting TLS-ALPN-01 challenge for domain %v on %v", chal.Identifier.Value, s.addr())
+	cert, err := acmez.TLSALPN01ChallengeCert(chal)
+	if err != nil {
+		return fmt.Errorf("failed to create challenge certificate: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.certs == nil {
+		s.certs = make(map[string]*tls.Certificate)
+	}
+	s.certs[strings.ToLower(chal.Identifier.Value)] = cert
+
+	if s.listener == nil {
+		ln, err := listen(s.addr(), "TLS-ALPN-01")
+		if err != nil {
+			return err
+		}
+		s.listener = tls.NewListener(ln, &tls.Config{
+			NextProtos:     []string{acmez.ACMETLS1Protocol},
+			GetCertificate: s.getCertificate,
+		})
+		go s.accept(s.listener)
+	}
+	return nil
+}
+
+func (s *StandaloneTlsAlpn01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Cleaning up TLS-ALPN-01 challenge for domain %v", chal.Identifier.Value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.certs, strings.ToLower(chal.Identifier.Value))
+	if len(s.certs) == 0 && s.listener != nil {
+		err := s.listener.Close()
+		s.listener = nil
+		return err
+	}
+	return nil
+}
+
+func (s *StandaloneTlsAlpn01Solver) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert, ok := s.certs[strings.ToLower(hello.ServerName)]
+	if !ok {
+		return nil, fmt.Errorf("no challenge for %q", hello.ServerName)
+	}
+	log.Printf("Answering TLS-ALPN-01 challenge for %v from %v", hello.ServerName, hello.Conn.RemoteAddr())
+	return cert, nil
+}
+
+// accept completes the handshake of each connection, which is all the validation needs
+func (s *StandaloneTlsAlpn01Solver) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TLS-ALPN-01 listener stopped: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				log.Printf("TLS-ALPN-01 handshake with %v failed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *StandaloneTlsAlpn01Solver) addr() string {
+	if s.Addr == "" {
+		return DefaultTlsAlpnAddr
+	}
+	return s.Addr
+}
+
+func listen(addr, challenge string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %v for %v challenges, the port may be in use or need privileges: %w", addr, challenge, err)
+	}
+	return ln, nil
+}
+
+func serve(server *http.Server, ln net.Listener) {
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP-01 server stopped: %v", err)
+	}
+}
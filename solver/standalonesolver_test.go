@@ -0,0 +1,166 @@
+package solver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func get(t *testing.T, method, url string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestStandaloneHttp01Solver(t *testing.T) {
+	addr := freeAddr(t)
+	s := &StandaloneHttp01Solver{Addr: addr}
+	ctx := context.Background()
+	chal, other := httpChallenge("www.example.com", "token"), httpChallenge("example.com", "other")
+
+	if err := s.Preflight(ctx, []string{"www.example.com"}); err != nil {
+		t.Fatalf("Preflight() error = %v", err)
+	}
+	for _, c := range []acme.Challenge{chal, other} {
+		if err := s.Present(ctx, c); err != nil {
+			t.Fatalf("Present() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+		body         string
+	}{
+		{http.MethodGet, "/.well-known/acme-challenge/token", http.StatusOK, chal.KeyAuthorization},
+		{http.MethodGet, "/.well-known/acme-challenge/other", http.StatusOK, other.KeyAuthorization},
+		{http.MethodGet, "/.well-known/acme-challenge/unknown", http.StatusNotFound, ""},
+		{http.MethodGet, "/token", http.StatusNotFound, ""},
+		{http.MethodPost, "/.well-known/acme-challenge/token", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		status, body := get(t, tt.method, "http://"+addr+tt.path)
+		if status != tt.want || (tt.body != "" && body != tt.body) {
+			t.Errorf("%v %v = %v %q, want %v %q", tt.method, tt.path, status, body, tt.want, tt.body)
+		}
+	}
+
+	// the server keeps serving the other challenges until the last one is cleaned up
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if status, _ := get(t, http.MethodGet, "http://"+addr+chal.HTTP01ResourcePath()); status != http.StatusNotFound {
+		t.Errorf("cleaned up challenge answered %v", status)
+	}
+	if status, body := get(t, http.MethodGet, "http://"+addr+other.HTTP01ResourcePath()); status != http.StatusOK || body != other.KeyAuthorization {
+		t.Errorf("other challenge answered %v %q", status, body)
+	}
+	if err := s.CleanUp(ctx, other); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if _, err := http.Get("http://" + addr + other.HTTP01ResourcePath()); err == nil {
+		t.Error("server still listening after the last CleanUp()")
+	}
+}
+
+func TestStandaloneSolverAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ctx := context.Background()
+
+	if err := (&StandaloneHttp01Solver{Addr: ln.Addr().String()}).Preflight(ctx, nil); err == nil || !strings.Contains(err.Error(), "HTTP-01") {
+		t.Errorf("Preflight() error = %v, want the address in use", err)
+	}
+	if err := (&StandaloneHttp01Solver{Addr: ln.Addr().String()}).Present(ctx, httpChallenge("example.com", "token")); err == nil {
+		t.Error("Present() succeeded on an address in use")
+	}
+	if err := (&StandaloneTlsAlpn01Solver{Addr: ln.Addr().String()}).Preflight(ctx, nil); err == nil || !strings.Contains(err.Error(), "TLS-ALPN-01") {
+		t.Errorf("Preflight() error = %v, want the address in use", err)
+	}
+}
+
+func TestStandaloneTlsAlpn01Solver(t *testing.T) {
+	addr := freeAddr(t)
+	s := &StandaloneTlsAlpn01Solver{Addr: addr}
+	ctx := context.Background()
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "www.example.com"},
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}
+
+	if err := s.Present(ctx, chal); err != nil {
+		t.Fatalf("Present() error = %v", err)
+	}
+	dial := func(serverName string) (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, NextProtos: []string{acmez.ACMETLS1Protocol}, InsecureSkipVerify: true})
+	}
+
+	conn, err := dial("WWW.example.com")
+	if err != nil {
+		t.Fatalf("handshake error = %v", err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	if state.NegotiatedProtocol != acmez.ACMETLS1Protocol {
+		t.Errorf("protocol = %q, want %v", state.NegotiatedProtocol, acmez.ACMETLS1Protocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "www.example.com" {
+		t.Errorf("certificate names = %v, want the domain", cert.DNSNames)
+	}
+	// the acmeIdentifier extension holds the digest of the key authorization
+	want := sha256.Sum256([]byte(chal.KeyAuthorization))
+	found := false
+	for _, ext := range cert.Extensions {
+		var digest []byte
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			_, err := asn1.Unmarshal(ext.Value, &digest)
+			found = err == nil && string(digest) == string(want[:])
+		}
+	}
+	if !found {
+		t.Error("certificate has no acmeIdentifier extension with the key authorization digest")
+	}
+
+	if _, err := dial("other.example.com"); err == nil {
+		t.Error("handshake succeeded for a domain without a challenge")
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if _, err := dial("www.example.com"); err == nil {
+		t.Error("listener still open after the last CleanUp()")
+	}
+}
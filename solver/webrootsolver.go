@@ -0,0 +1,95 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/export"
+	"github.com/mholt/acmez/acme"
+)
+
+// WebrootHttp01Solver answers HTTP-01 challenges with files in the document root of a web server that is
+// already running, such as nginx or Apache, which serves them under /.well-known/acme-challenge/.
+type WebrootHttp01Solver struct {
+	Root          string
+	Resolvers     []string // resolvers to look up the addresses of the domains with, the system resolvers when empty
+	WaitTimeout   time.Duration
+	SkipIPv6Check bool // checks the challenge through the IPv4 addresses only
+}
+
+// Preflight checks the document root exists before the order is placed
+func (s WebrootHttp01Solver) Preflight(ctx context.Context, domains []string) error {
+	info, err := os.Stat(s.Root)
+	if err != nil {
+		return fmt.Errorf("webroot: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("webroot %v is not a directory", s.Root)
+	}
+	return nil
+}
+
+func (s WebrootHttp01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+	path := s.challengePath(chal)
+	log.Printf("Presenting challenge for domain %v in %v", chal.Identifier.Value, path)
+
+	if err := mkdirReadable(s.Root, ".well-known", "acme-challenge"); err != nil {
+		return err
+	}
+	// The web server usually runs as another user, the key authorization is not secret
+	if err := export.WriteFileAtomic(path, []byte(chal.KeyAuthorization), 0644); err != nil {
+		return fmt.Errorf("failed to write challenge file: %w", err)
+	}
+	return nil
+}
+
+func (s WebrootHttp01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	path := s.challengePath(chal)
+	log.Printf("Cleaning up challenge for domain %v in %v", chal.Identifier.Value, path)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove challenge file: %w", err)
+	}
+	return nil
+}
+
+// Wait checks the web server serves the challenge file for the domain on every address of the domain
+func (s WebrootHttp01Solver) Wait(ctx context.Context, chal acme.Challenge) error {
+	log.Printf("Waiting for challenge for domain %v at path %v", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	chkCtx, cancel := withWaitTimeout(ctx, s.WaitTimeout)
+	defer cancel()
+
+	log.Printf("Checking URL http://%v%v on every address", chal.Identifier.Value, chal.HTTP01ResourcePath())
+	if err := checkAllAddrs(chkCtx, chal.Identifier.Value, chal.Identifier.Value, chal.HTTP01ResourcePath(), chal.KeyAuthorization, s.Resolvers, s.SkipIPv6Check); err != nil {
+		return fmt.Errorf("failed waiting for challenge, check that %v is served from %v: %w", chal.HTTP01ResourcePath(), s.Root, err)
+	}
+	log.Printf("Challenge is ready for domain %v", chal.Identifier.Value)
+	return nil
+}
+
+func (s WebrootHttp01Solver) challengePath(chal acme.Challenge) string {
+	return filepath.Join(s.Root, filepath.FromSlash(chal.HTTP01ResourcePath()))
+}
+
+// mkdirReadable creates the missing directories below root readable by everyone, regardless of the umask
+func mkdirReadable(root string, dirs ...string) error {
+	path := root
+	for _, dir := range dirs {
+		path = filepath.Join(path, dir)
+		err := os.Mkdir(path, 0755)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to create %v: %w", path, err)
+		}
+		if err := os.Chmod(path, 0755); err != nil {
+			return fmt.Errorf("failed to set permissions of %v: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package solver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/acmez/acme"
+)
+
+func TestWebrootHttp01Solver(t *testing.T) {
+	root := t.TempDir()
+	s := WebrootHttp01Solver{Root: root}
+	ctx := context.Background()
+	chal, other := httpChallenge("www.example.com", "token"), httpChallenge("example.com", "other")
+	// the web server serves the document root
+	srv := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer srv.Close()
+
+	if err := s.Preflight(ctx, []string{"www.example.com"}); err != nil {
+		t.Fatalf("Preflight() error = %v", err)
+	}
+	for _, c := range []acme.Challenge{chal, other} {
+		if err := s.Present(ctx, c); err != nil {
+			t.Fatalf("Present() error = %v", err)
+		}
+	}
+
+	// the files are readable by the web server running as another user
+	for path, mode := range map[string]os.FileMode{
+		".well-known":                      0755,
+		".well-known/acme-challenge":       0755,
+		".well-known/acme-challenge/token": 0644,
+	} {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("mode of %v = %v, want %v", path, info.Mode().Perm(), mode)
+		}
+	}
+	if status, body := get(t, http.MethodGet, srv.URL+chal.HTTP01ResourcePath()); status != http.StatusOK || body != chal.KeyAuthorization {
+		t.Errorf("GET %v = %v %q, want the key authorization", chal.HTTP01ResourcePath(), status, body)
+	}
+
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	if status, _ := get(t, http.MethodGet, srv.URL+chal.HTTP01ResourcePath()); status != http.StatusNotFound {
+		t.Errorf("cleaned up challenge answered %v", status)
+	}
+	if status, body := get(t, http.MethodGet, srv.URL+other.HTTP01ResourcePath()); status != http.StatusOK || body != other.KeyAuthorization {
+		t.Errorf("other challenge answered %v %q", status, body)
+	}
+	// cleaning up again finds nothing to remove
+	if err := s.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("CleanUp() error = %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, ".well-known", "acme-challenge"))
+	if len(entries) != 1 || entries[0].Name() != "other" {
+		t.Errorf("challenge files = %v, want the other challenge only", entries)
+	}
+}
+
+func TestWebrootHttp01SolverPreflight(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, path := range []string{filepath.Join(root, "missing"), file} {
+		if err := (WebrootHttp01Solver{Root: path}).Preflight(ctx, nil); err == nil {
+			t.Errorf("Preflight() succeeded for %v", path)
+		}
+	}
+	if err := (WebrootHttp01Solver{Root: filepath.Join(root, "missing")}).Present(ctx, httpChallenge("example.com", "token")); err == nil {
+		t.Error("Present() succeeded in a missing document root")
+	}
+}
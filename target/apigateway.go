@@ -0,0 +1,56 @@
+package target
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"log"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/DefangLabs/cloudacme/aws/acm"
+	"github.com/DefangLabs/cloudacme/aws/apigateway"
+)
+
+// ApiGateway deploys certificates to an API Gateway custom domain name. API Gateway does not route
+// HTTP-01 challenges, the certificate has to be obtained with a DNS-01 solver.
+type ApiGateway struct {
+	DomainName string
+	Version    int // 1 or 2, detected when 0
+	History    acme.CertificateHistory
+}
+
+// Deploy reimports the certificate into the ACM certificate configured on the domain name when it is an
+// imported certificate, otherwise imports a new certificate, and makes sure the domain name uses it.
+func (t ApiGateway) Deploy(ctx context.Context, key crypto.Signer, chain []byte) (string, error) {
+	dn, err := apigateway.GetDomainName(ctx, t.DomainName, t.Version)
+	if err != nil {
+		return "", fmt.Errorf("failed to get domain name %v: %w", t.DomainName, err)
+	}
+
+	certArn := dn.CertificateArn
+	if certArn != "" {
+		imported, err := acm.IsImported(ctx, certArn)
+		if err != nil {
+			return "", fmt.Errorf("failed to describe certificate %v: %w", certArn, err)
+		}
+		if !imported {
+			log.Printf("Certificate %v of domain name %v is not an imported certificate, importing a new certificate", certArn, t.DomainName)
+			certArn = ""
+		}
+	}
+
+	region := ""
+	if dn.Edge {
+		region = apigateway.EdgeCertificateRegion
+	}
+	certArn, err = acme.ImportCertificate(ctx, t.History, region, key, chain, certArn, acme.ManagedCertificateTags(t.DomainName, acme.TargetApiGateway))
+	if err != nil {
+		return certArn, fmt.Errorf("failed to import certificate: %w", err)
+	}
+
+	if err := apigateway.SetCertificate(ctx, dn, certArn); err != nil {
+		return certArn, fmt.Errorf("failed to update domain name %v: %w", t.DomainName, err)
+	}
+	log.Printf("API Gateway v%d domain name %v uses certificate %v", dn.Version, t.DomainName, certArn)
+	return certArn, nil
+}
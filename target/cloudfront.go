@@ -0,0 +1,65 @@
+package target
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/DefangLabs/cloudacme/acme"
+	"github.com/DefangLabs/cloudacme/aws/acm"
+	"github.com/DefangLabs/cloudacme/aws/cloudfront"
+)
+
+// CloudFront deploys certificates as the viewer certificate of a CloudFront distribution. CloudFront cannot
+// run the ALB HTTP-01 flow itself, the certificate has to be obtained with a DNS-01 solver or an HTTP-01
+// solver on the distribution's origin.
+type CloudFront struct {
+	DistributionId string
+	History        acme.CertificateHistory
+}
+
+// Deploy imports the certificate into ACM in us-east-1, reimporting the certificate the distribution already
+// uses when it is managed by cloudacme for the domain, and sets it as the viewer certificate of the
+// distribution.
+func (t CloudFront) Deploy(ctx context.Context, domain string, key crypto.Signer, chain []byte) (string, error) {
+	dist, err := cloudfront.GetDistribution(ctx, t.DistributionId)
+	if err != nil {
+		return "", fmt.Errorf("failed to get distribution %v: %w", t.DistributionId, err)
+	}
+	if !slices.Contains(dist.Aliases, domain) {
+		log.Printf("Domain %v is not an alternate domain name of distribution %v", domain, t.DistributionId)
+	}
+
+	certArn := ""
+	if dist.ACMCertificateArn != "" {
+		tags, err := acm.ListTags(ctx, dist.ACMCertificateArn)
+		if err != nil {
+			return "", fmt.Errorf("failed to get tags of certificate %v: %w", dist.ACMCertificateArn, err)
+		}
+		// the distribution may use a certificate managed for another of its aliases, or for an ALB in
+		// us-east-1, certificates imported before the target tag was added have none
+		target := tags[acme.TagTarget]
+		if tags[acme.TagManaged] == "true" && tags[acme.TagDomain] == domain && (target == "" || target == acme.TargetCloudFront) {
+			certArn = dist.ACMCertificateArn
+		}
+	}
+	if certArn == "" {
+		certArn, err = acm.FindImportedCertificateByTags(ctx, cloudfront.CertificateRegion, acme.ManagedCertificateTags(domain, acme.TargetCloudFront))
+		if err != nil {
+			return "", fmt.Errorf("failed to find certificate by tags: %w", err)
+		}
+	}
+
+	certArn, err = acme.ImportCertificate(ctx, t.History, cloudfront.CertificateRegion, key, chain, certArn, acme.ManagedCertificateTags(domain, acme.TargetCloudFront))
+	if err != nil {
+		return certArn, fmt.Errorf("failed to import certificate: %w", err)
+	}
+
+	if err := cloudfront.SetViewerCertificate(ctx, t.DistributionId, certArn); err != nil {
+		return certArn, fmt.Errorf("failed to update distribution %v: %w", t.DistributionId, err)
+	}
+	log.Printf("Distribution %v uses certificate %v", t.DistributionId, certArn)
+	return certArn, nil
+}
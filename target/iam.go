@@ -0,0 +1,206 @@
+package target
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/DefangLabs/cloudacme/aws/alb"
+	"github.com/DefangLabs/cloudacme/aws/cloudfront"
+	"github.com/DefangLabs/cloudacme/aws/ec2"
+	"github.com/DefangLabs/cloudacme/aws/elb"
+	"github.com/DefangLabs/cloudacme/aws/iam"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancing/types"
+)
+
+const DefaultIAMPath = "/cloudacme/"
+
+const maxListenerUpdateRetries = 10
+
+// ClassicListener is the HTTPS or SSL listener of a Classic Load Balancer
+type ClassicListener struct {
+	LoadBalancerName string
+	Port             int32
+}
+
+// IAMServerCertificate deploys certificates as IAM server certificates. Every certificate is uploaded under
+// a new versioned name, Name-<not before timestamp>, as IAM server certificates cannot be replaced in place.
+type IAMServerCertificate struct {
+	Name      string
+	Path      string
+	Listeners []ClassicListener
+}
+
+// Deploy uploads the certificate, points the listeners at it and deletes the older versions that are no
+// longer in use.
+func (t IAMServerCertificate) Deploy(ctx context.Context, key crypto.Signer, chain []byte) (string, error) {
+	path := t.Path
+	if path == "" {
+		path = DefaultIAMPath
+	}
+
+	leafPem, chainPem, leaf, err := splitChain(chain)
+	if err != nil {
+		return "", err
+	}
+	keyPem, err := encodeTraditionalKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	name := t.versionName(leaf)
+	cert, err := iam.UploadServerCertificate(ctx, name, path, leafPem, chainPem, keyPem)
+	if iam.IsAlreadyExists(err) {
+		log.Printf("Server certificate %v already uploaded", name)
+		cert, err = iam.GetServerCertificate(ctx, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to upload server certificate %v: %w", name, err)
+	}
+	log.Printf("Uploaded server certificate %v as %v", name, cert.Arn)
+
+	for _, l := range t.Listeners {
+		if err := setListenerCertificate(ctx, l, cert.Arn); err != nil {
+			return cert.Arn, fmt.Errorf("failed to update listener %v:%d: %w", l.LoadBalancerName, l.Port, err)
+		}
+		log.Printf("Listener %v:%d uses server certificate %v", l.LoadBalancerName, l.Port, name)
+	}
+
+	if err := t.deleteUnusedVersions(ctx, path, name); err != nil {
+		log.Printf("Failed to clean up old versions of server certificate %v: %v", t.Name, err)
+	}
+	return cert.Arn, nil
+}
+
+const versionLayout = "20060102T150405Z"
+
+func (t IAMServerCertificate) versionName(leaf *x509.Certificate) string {
+	return t.Name + "-" + leaf.NotBefore.UTC().Format(versionLayout)
+}
+
+// isVersion reports whether name is a versioned name of the certificate, so that certificates named with
+// Name and a dash as prefix, like Name-staging, are not taken for older versions
+func (t IAMServerCertificate) isVersion(name string) bool {
+	timestamp, ok := strings.CutPrefix(name, t.Name+"-")
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(versionLayout, timestamp)
+	return err == nil
+}
+
+// deleteUnusedVersions deletes the versions of the certificate other than current that no load balancer or
+// CloudFront distribution uses. IAM deletes a server certificate even while a listener uses it, which breaks
+// the listener, so the versions in use are looked up and kept. Server certificates are global, the load
+// balancers of every enabled region are checked, and nothing is deleted when a region cannot be checked.
+func (t IAMServerCertificate) deleteUnusedVersions(ctx context.Context, path, current string) error {
+	certs, err := iam.ListServerCertificates(ctx, path)
+	if err != nil {
+		return err
+	}
+	regions, err := ec2.EnabledRegions(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list the regions to check for load balancers using the certificate, not deleting: %w", err)
+	}
+	inUse := make(map[string]bool)
+	for _, region := range regions {
+		elbInUse, err := elb.GetCertificatesInUse(ctx, region)
+		if err != nil {
+			return fmt.Errorf("cannot check the Classic Load Balancers in %v, not deleting: %w", region, err)
+		}
+		maps.Copy(inUse, elbInUse)
+		albInUse, err := alb.GetCertificatesInUse(ctx, region)
+		if err != nil {
+			return fmt.Errorf("cannot check the load balancers in %v, not deleting: %w", region, err)
+		}
+		maps.Copy(inUse, albInUse)
+	}
+	// CloudFront only uses server certificates uploaded under the /cloudfront/ path, and refers to them by id
+	if strings.HasPrefix(path, "/cloudfront/") {
+		cfInUse, err := cloudfront.GetIAMCertificatesInUse(ctx)
+		if err != nil {
+			return err
+		}
+		maps.Copy(inUse, cfInUse)
+	}
+
+	for _, cert := range certs {
+		if cert.Name == current || !t.isVersion(cert.Name) {
+			continue
+		}
+		if inUse[cert.Arn] || inUse[cert.Id] {
+			log.Printf("Keeping server certificate %v, it is used by a load balancer or distribution", cert.Name)
+			continue
+		}
+		err := iam.DeleteServerCertificate(ctx, cert.Name)
+		if errors.Is(err, iam.ErrInUse) {
+			log.Printf("Keeping server certificate %v, it is still in use", cert.Name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to delete server certificate %v: %w", cert.Name, err)
+		}
+		log.Printf("Deleted server certificate %v", cert.Name)
+	}
+	return nil
+}
+
+// setListenerCertificate retries while a newly uploaded certificate is not yet visible to Elastic Load Balancing
+func setListenerCertificate(ctx context.Context, l ClassicListener, certArn string) error {
+	for i := 0; ; i++ {
+		err := elb.SetListenerCertificate(ctx, l.LoadBalancerName, l.Port, certArn)
+		var notFoundErr *types.CertificateNotFoundException
+		if errors.As(err, &notFoundErr) && i < maxListenerUpdateRetries {
+			log.Printf("Server certificate not found yet, retrying (%d/%d)...", i+1, maxListenerUpdateRetries)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		return err
+	}
+}
+
+// ParseClassicListener parses a listener in the form load-balancer-name:port
+func ParseClassicListener(s string) (ClassicListener, error) {
+	name, portStr, ok := strings.Cut(s, ":")
+	var port int32
+	if _, err := fmt.Sscanf(portStr, "%d", &port); !ok || err != nil || name == "" {
+		return ClassicListener{}, fmt.Errorf("invalid listener %q, expected load-balancer-name:port", s)
+	}
+	return ClassicListener{LoadBalancerName: name, Port: port}, nil
+}
+
+func splitChain(chain []byte) (leafPem, chainPem []byte, leaf *x509.Certificate, err error) {
+	block, rest := pem.Decode(chain)
+	if block == nil {
+		return nil, nil, nil, errors.New("no certificate in chain")
+	}
+	leaf, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return pem.EncodeToMemory(block), []byte(strings.TrimSpace(string(rest))), leaf, nil
+}
+
+// encodeTraditionalKey encodes the key in the PKCS#1 or SEC 1 PEM format older services expect
+func encodeTraditionalKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal private key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}